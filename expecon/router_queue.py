@@ -0,0 +1,41 @@
+import json
+import os
+import urllib
+import redis
+from django.conf import settings
+
+'''
+	Reads session queues as stored by the router. Once the router has
+	compacted a session, the first session_archived:<instance>:<id> messages
+	of its queue live in the archive under ROUTER_DATA_DIR instead of Redis.
+	The archive layout must match go/src/expecon-router/database_file.go.
+'''
+
+def archive_path(instance, session_id):
+	# same escaping as Go's url.PathEscape
+	name = '%d-%s' % (session_id, urllib.quote(instance, safe="$&+,:;=@~"))
+	return os.path.join(settings.ROUTER_DATA_DIR, 'archive', name, 'messages.log')
+
+''' Returns the whole queue of the given session as a list of messages '''
+def load_queue(instance, session_id):
+	r = redis.Redis(host=settings.REDIS_HOST, port=settings.REDIS_PORT, db=settings.REDIS_DB)
+	# read both in one transaction, so a compaction can't shift the list in between
+	pipe = r.pipeline()
+	pipe.get('session_archived:%s:%d' % (instance, session_id))
+	pipe.lrange('session:%s:%d' % (instance, session_id), 0, -1)
+	archived, tail = pipe.execute()
+	archived = int(archived or 0)
+
+	queue = []
+	if archived:
+		if not settings.ROUTER_DATA_DIR:
+			raise IOError('session %d has archived messages, but ROUTER_DATA_DIR is not set' % session_id)
+		with open(archive_path(instance, session_id)) as f:
+			for line in f:
+				if len(queue) == archived:
+					break
+				queue.append(json.loads(line))
+		if len(queue) < archived:
+			raise IOError('archive of session %d is missing messages' % session_id)
+	queue.extend(map(json.loads, tail))
+	return queue
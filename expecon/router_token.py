@@ -0,0 +1,36 @@
+import base64
+import hashlib
+import hmac
+import json
+import time
+from django.conf import settings
+
+'''
+	Signed tokens that let the router check a websocket connection was handed
+	out by this app. Must match the format in go/src/expecon-router/token.go:
+	base64url(claims) + '.' + base64url(HMAC-SHA256(secret, base64url(claims)))
+'''
+
+TOKEN_LIFETIME = 12 * 60 * 60
+
+def encode(data):
+	return base64.urlsafe_b64encode(data).rstrip('=')
+
+def make_token(secret, instance, session, subject, lifetime=TOKEN_LIFETIME):
+	claims = json.dumps({
+		'instance': instance,
+		'session': session,
+		'subject': subject,
+		'expires': int(time.time()) + lifetime,
+	}, separators=(',', ':'))
+	encoded = encode(claims)
+	signature = encode(hmac.new(str(secret), encoded, hashlib.sha256).digest())
+	return encoded + '.' + signature
+
+''' Sets the cookie the router looks for when subject connects to session, if a router secret is configured '''
+def set_token_cookie(response, session, subject):
+	if settings.ROUTER_SECRET:
+		instance = settings.URL_PREFIX.strip('/')
+		token = make_token(settings.ROUTER_SECRET, instance, session.id, subject)
+		response.set_cookie('redwood_token_%d_%s' % (session.id, subject), token, max_age=TOKEN_LIFETIME)
+	return response
@@ -8,6 +8,11 @@ Redwood.factory('Admin', ['$q', '$timeout', '$rootScope', 'RedwoodCore', functio
 	ra.user_id = rw.user_id;
 	ra.set_period = rw.set_period;
 	ra.set_group = rw.set_group;
+	// moves subjects (all of them if omitted) to period, the router draws
+	// their groups by the matching column of the config
+	ra.assign = function(period, user_ids) {
+		rw.send("__assign__", { period: period, subjects: user_ids || [] });
+	};
 	ra.on_load = rw.on_load;
 	ra.subjects = [];
 	ra.subject = {};
@@ -49,7 +54,23 @@ Redwood.factory('Admin', ['$q', '$timeout', '$rootScope', 'RedwoodCore', functio
 		ra.__send__(key, value, user_id, ra.periods[user_id], ra.groups[user_id]);
 	};
 
-	ra.sendCustom = ra.__send__;
+	// the router routes messages by the sender's period and group, a custom
+	// period and group is an explicit override it logs
+	ra.sendCustom = function(key, value, sender, period, group) {
+		rw.send(key, value, { period: period || 0, group: group || 0, sender: sender || ra.user_id, override: true });
+	};
+
+	// reveal the sealed messages with key, of all periods and groups unless
+	// given
+	ra.reveal = function(key, period, group) {
+		ra.__send__("__reveal__", { key: key || "", period: period || 0, group: group || 0 }, ra.user_id, 0, 0);
+	};
+
+	// close the auction, or clear the double auction book, of a period and
+	// group
+	ra.close_market = function(period, group) {
+		ra.__send__("__close_market__", { period: period, group: group || 0 }, ra.user_id, 0, 0);
+	};
 
 	ra.trigger = function(key, value) {
 		ra.__send__(key, value, ra.user_id, 0, 0);
@@ -196,6 +217,48 @@ Redwood.factory('Admin', ['$q', '$timeout', '$rootScope', 'RedwoodCore', functio
 		ra.subject[sender].period = value.period;
 	});
 
+	// state of the router side barriers, by period, group and name
+	ra.barriers = {};
+	ra._barrier = function(name, period, group) {
+		var key = period + ":" + group + ":" + name;
+		if(!ra.barriers[key]) {
+			ra.barriers[key] = { name: name, period: period, group: group, ready: {}, released: false };
+		}
+		return ra.barriers[key];
+	};
+	rw.recv(rw.KEY.__queue_start__, function(msg) {
+		ra.barriers = {};
+		var barriers = (msg.Value && msg.Value.barriers) || [];
+		for(var i = 0; i < barriers.length; i++) {
+			var barrier = barriers[i];
+			ra.barriers[barrier.period + ":" + barrier.group + ":" + barrier.name] = barrier;
+		}
+	});
+	rw.recv("__ready__", function(msg) {
+		ra._barrier(msg.Value.name, msg.Period, msg.Group).ready[msg.Sender] = true;
+	});
+	rw.recv("__release__", function(msg) {
+		ra._barrier(msg.Value.name, msg.Period, msg.Group).released = true;
+	});
+
+	// presence of each subject as seen by the router's heartbeats:
+	// connected, disconnected or reconnected
+	ra.presence = {};
+	ra.online = function(user_id) {
+		return !!ra.presence[user_id] && ra.presence[user_id] !== "disconnected";
+	};
+	ra.on_presence = function(f) {
+		rw.recv("__presence__", function(msg) {
+			f(msg.Value.subject, msg.Value.status);
+		});
+	};
+	rw.recv(rw.KEY.__queue_start__, function(msg) {
+		ra.presence = (msg.Value && msg.Value.presence) || {};
+	});
+	ra.on_presence(function(user_id, status) {
+		ra.presence[user_id] = status;
+	});
+
 
 	ra.pause = function() {
 		for(var i = 0; i < ra.subjects.length; i++) {
@@ -60,10 +60,26 @@ Redwood.factory("RedwoodCore", ["$compile", "$controller", "$rootScope", "$timeo
 		var port = 8080;
 		var url = "ws://" + host + ":" + port + rw.__instance__ + "/" + rw.__session__ + "/" + rw.user_id;
 
+		// after a dropped connection, only ask for what we missed
+		rw.__resuming__ = !!(rw.__nonce__ && rw.__cursor__);
+		if (rw.__resuming__) {
+			url += "?nonce=" + encodeURIComponent(rw.__nonce__) + "&since=" + rw.__cursor__;
+		}
+
 		rw.__ws__ = new WebSocket(url);
 
 		rw.__ws__.onopen = function() {
 
+			rw.send = rw.__default_send__;
+			rw.__sync__ = {in_progress: false};
+			rw.__broadcast__({
+				Key: rw.KEY.__router_status__,
+				Value: {connected: true}
+			});
+			if (rw.__resuming__) {
+				return;
+			}
+
 			// public
 			rw.subjects = [];
 			rw.points = {}; //by subject
@@ -74,13 +90,6 @@ Redwood.factory("RedwoodCore", ["$compile", "$controller", "$rootScope", "$timeo
 			rw.configs = [];
 			rw.recv_queue = [];
 			rw.time_delta = 0;
-			rw.send = rw.__default_send__;
-
-			rw.__sync__ = {in_progress: false};
-			rw.__broadcast__({
-				Key: rw.KEY.__router_status__,
-				Value: {connected: true}
-			});
 		};
 
 		rw.__ws__.onerror = function(e) {
@@ -93,6 +102,12 @@ Redwood.factory("RedwoodCore", ["$compile", "$controller", "$rootScope", "$timeo
 
 		rw.__ws__.onclose = function(e) {
 			rw.send = rw.__error_send__;
+			// the router is restarting, reconnect as soon as it is back
+			// instead of alarming the subject
+			if (e.reason === "server restarting") {
+				rw.__retry_connect__(1);
+				return;
+			}
 			rw.__broadcast__({
 				Key: rw.KEY.__router_status__,
 				Value: {connected: false, details: e}
@@ -115,6 +130,15 @@ Redwood.factory("RedwoodCore", ["$compile", "$controller", "$rootScope", "$timeo
 						+ ", " + msg.Value);
 				}
 				if(msg.Key === rw.KEY.__queue_start__) {
+					if(rw.__resuming__) {
+						if(msg.Value && msg.Value.resumed) {
+							// the page is already loaded, don't announce it again
+							rw.__is_reload__ = true;
+						} else {
+							// the session was reset while we were away
+							rw.__pending_reload__ = true;
+						}
+					}
 					rw.__nonce__ = msg.Nonce;
 					rw.__sync__.in_progress = true;
 					rw.__sync__.send = rw.send;
@@ -127,7 +151,12 @@ Redwood.factory("RedwoodCore", ["$compile", "$controller", "$rootScope", "$timeo
 						rw.send(rw.KEY.__page_loaded__);
 					}
 					processSendQueue();
-				} else if(rw.__sync__.in_progress) {
+				} else if(msg.Time > (rw.__cursor__ || 0)) {
+					// Time is in nanoseconds, which a double can't hold exactly,
+					// but router timestamps are far enough apart for resuming
+					rw.__cursor__ = msg.Time;
+				}
+				if(rw.__sync__.in_progress && msg.Key !== rw.KEY.__queue_start__) {
 					var key = getMsgId(msg);
 					for(var i = 0; i < rw.__send_queue__.length; i++) {
 						if(rw.__send_queue__[i].key === key) {
@@ -189,6 +218,9 @@ Redwood.factory("RedwoodCore", ["$compile", "$controller", "$rootScope", "$timeo
 			Group: args.group,
 			Sender: args.sender,
 			StateUpdate: args.state_update,
+			Override: args.override,
+			Recipients: args.recipients,
+			Sealed: args.sealed,
 			Key: key,
 			Value: value,
 			ClientTime: new Date().getTime()
@@ -97,6 +97,18 @@ Redwood.factory("RedwoodSubject", ["$q", "$rootScope", "$timeout", "RedwoodCore"
 		rs._send(key, value);
 	};
 
+	// send a message only the given subjects (and the admin) receive
+	rs.send_to = function(recipients, key, value) {
+		rs._send(key, value, { recipients: [].concat(recipients) });
+	};
+
+	// send a message the router keeps from the rest of the group until it
+	// is revealed: on the admin's command ("admin", the default), once the
+	// period ends ("period") or once the whole group has sent key ("all")
+	rs.send_sealed = function(key, value, reveal) {
+		rs._send(key, value, { sealed: reveal || "admin" });
+	};
+
 	rs.recv = function(key, f) {
 		if(!rs._msg_handlers[key]) {
 			rs._msg_handlers[key] = [];
@@ -167,8 +179,10 @@ Redwood.factory("RedwoodSubject", ["$q", "$rootScope", "$timeout", "RedwoodCore"
 		});
 	};
 
+	// the router stamps every message with the subject's period, only the
+	// admin can send to period 0
 	rs.set = function(key, value) {
-		rs._send(key, value, {period: 0});
+		rs._send(key, value);
 	};
 
 	rs.save = function(key, value) {
@@ -432,6 +446,115 @@ Redwood.factory("RedwoodSubject", ["$q", "$rootScope", "$timeout", "RedwoodCore"
 		});
 	});
 
+	// the router knows about pauses the admin has scheduled
+	rw.recv(rw.KEY.__queue_start__, function(msg) {
+		if(msg.Value && msg.Value.paused && rs.user_id in msg.Value.paused) {
+			rs._pause[msg.Value.paused[rs.user_id]] = true;
+		}
+	});
+
+	// router side timers of the current period and group: f is called with
+	// the milliseconds remaining on every tick and with 0 when it expires
+	rs._timer_handlers = {};
+
+	rs.start_timer = function(name, duration, interval) {
+		rs._send("__start_timer__", { name: name, duration: duration, interval: interval || 0 });
+	};
+
+	rs.on_timer = function(name, f) {
+		if(!rs._timer_handlers[name]) {
+			rs._timer_handlers[name] = [];
+		}
+		rs._timer_handlers[name].push(f);
+	};
+
+	rs._handle_timer = function(timer) {
+		var handlers = rs._timer_handlers[timer.name] || [];
+		for(var i = 0; i < handlers.length; i++) {
+			handlers[i].call(rs, timer.remaining);
+		}
+	};
+
+	rw.recv(rw.KEY.__queue_start__, function(msg) {
+		// a reloaded page picks up running timers where they are
+		var timers = (msg.Value && msg.Value.timers) || [];
+		for(var i = 0; i < timers.length; i++) {
+			rs._handle_timer(timers[i]);
+		}
+	});
+
+	rw.recv("__timer_tick__", function(msg) {
+		rs._handle_timer(msg.Value);
+	});
+
+	rw.recv("__timer_expired__", function(msg) {
+		rs._handle_timer(msg.Value);
+	});
+
+	// router side barriers of the current period and group: f is called
+	// once every subject of the group has called rs.ready(name)
+	rs._release_handlers = {};
+
+	rs.ready = function(name) {
+		rs._send("__ready__", { name: name });
+	};
+
+	rs.on_release = function(name, f) {
+		if(!rs._release_handlers[name]) {
+			rs._release_handlers[name] = [];
+		}
+		rs._release_handlers[name].push(f);
+	};
+
+	rw.recv("__release__", function(msg) {
+		var handlers = rs._release_handlers[msg.Value.name] || [];
+		for(var i = 0; i < handlers.length; i++) {
+			handlers[i].call(rs, msg.Value.subjects);
+		}
+	});
+
+	// router side markets, enabled by the "market" column of the config:
+	// bids go to a sealed-bid auction, orders to a double auction, and the
+	// router answers with every trade and the book of the market
+	rs._trade_handlers = [];
+	rs._book_handlers = [];
+
+	rs.bid = function(price) {
+		rs._send("__bid__", { price: price });
+	};
+
+	rs.order = function(side, price, quantity) {
+		rs._send("__order__", { side: side, price: price, quantity: quantity || 1 });
+	};
+
+	rs.cancel_order = function(id) {
+		rs._send("__cancel__", { id: id });
+	};
+
+	rs.on_trade = function(f) {
+		rs._trade_handlers.push(f);
+	};
+
+	rs.on_book = function(f) {
+		rs._book_handlers.push(f);
+	};
+
+	rw.recv("__trade__", function(msg) {
+		for(var i = 0; i < rs._trade_handlers.length; i++) {
+			rs._trade_handlers[i].call(rs, msg.Value);
+		}
+	});
+
+	rw.recv("__book__", function(msg) {
+		for(var i = 0; i < rs._book_handlers.length; i++) {
+			rs._book_handlers[i].call(rs, msg.Value);
+		}
+	});
+
+	rw.recv_self("__pause__", function(msg) {
+		rs._pause[msg.Value.period] = true;
+	});
+
 	rw.recv_self("__paused__", function(msg) {
 		$rootScope.$emit('messageModal', 'pausedModal', pausedModal);
 	});
@@ -91,10 +91,16 @@ Redwood.controller("AdminCtrl", ["$rootScope", "$scope", "Admin", function($root
 						$("<td>").text(ra.subjects[i].user_id).after(
 							$("<td>").text(0).after(
 								$("<td>").text(0).after(
-									$("<td>").text(""))))));
+									$("<td>").text("").after(
+										$("<td>").text(ra.presence[ra.subjects[i].user_id] || "")))))));
 				}
 			});
 
+			ra.on_presence(function(user, status) { //Display whether each user is online
+				$("tr.subject-" + user + " :nth-child(5)").text(status);
+				$("tr.subject-" + user).toggleClass("danger", status === "disconnected");
+			});
+
 			ra.on_set_config(function(config) { //Display the config file
 				$("table.config").empty();
 				var a = $.csv.toArrays(config);
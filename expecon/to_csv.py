@@ -42,7 +42,7 @@ def parse_config(o):
 
 def queue_to_csv(l):
 	rows = []
-	header =  ['Period', 'Group', 'Sender', 'Time', 'ClientTime', 'Key', 'Value']
+	header =  ['Period', 'Group', 'Sender', 'Origin', 'Time', 'ClientTime', 'Sealed', 'Submitted', 'Key', 'Value']
 	rows.append(header)
 	groups = {}
 	configs = {}
@@ -11,6 +11,8 @@ from django.db.models import Q
 from django.conf import settings
 from django.core import serializers
 from to_csv import queue_to_csv
+from router_token import set_token_cookie
+from router_queue import load_queue
 import json
 import datetime
 import subprocess
@@ -26,12 +28,13 @@ import codecs
 @login_required
 def session_admin(request, session):
 	session = get_object_or_404(Session, pk=session)
-	return HttpResponse(
+	response = HttpResponse(
 		Page(experiment=session.experiment,
 				 name="Admin",
 				 html=session.experiment.admin_html,
 				 css=session.experiment.admin_css,
 				 js=session.experiment.admin_js).render(context_instance=RequestContext(request)))
+	return set_token_cookie(response, session, 'admin')
 
 ''' Displays the rt_js page defined for the given session's experiment '''
 @login_required			 
@@ -40,14 +43,16 @@ def session_data(request, session):
 	if request.method == 'POST':
 		session.experiment.rt_js = request.POST["script"]
 		session.experiment.save()
-	return render_to_response('session_data.html', {'session': session}, context_instance=RequestContext(request))
+	response = render_to_response('session_data.html', {'session': session}, context_instance=RequestContext(request))
+	return set_token_cookie(response, session, 'listener')
 
 ''' Displays the session_payouts.html template '''
 @login_required	
 def session_payouts(request, session):
 	session = get_object_or_404(Session, pk=session)
-	return render_to_response('session_payouts.html',
+	response = render_to_response('session_payouts.html',
 		context_instance=RequestContext(request))
+	return set_token_cookie(response, session, 'listener')
 		
 ''' 
 	Downloads the session queue from Redis, then converts to a csv file.
@@ -71,9 +76,8 @@ def session_download(request, session):
 	session = get_object_or_404(Session, pk=session)
 	s = cStringIO.StringIO()
 	w = csv.writer(s)
-	r = redis.Redis(host=settings.REDIS_HOST, port=settings.REDIS_PORT, db=settings.REDIS_DB)
 	instance = settings.URL_PREFIX.strip('/')
-	queue = map(json.loads, r.lrange('session:%s:%d' % (instance, session.id), 0, -1))
+	queue = load_queue(instance, session.id)
 	# the filename is suffixed by the timestamp of the first message in the queue
 	timestamp = datetime.datetime.fromtimestamp(queue[0]['Time'] / 1e9)
 	rows = queue_to_csv(queue)
@@ -88,9 +92,8 @@ def session_download(request, session):
 def session_archive(request, session):
 	if request.method == 'GET':
 		session = get_object_or_404(Session, pk=session)
-		r = redis.Redis(host=settings.REDIS_HOST, port=settings.REDIS_PORT, db=settings.REDIS_DB)
 		instance = settings.URL_PREFIX.strip('/')
-		queue = map(json.loads, r.lrange('session:%s:%d' % (instance, session.id), 0, -1))
+		queue = load_queue(instance, session.id)
 		session.archive = ''
 		objs = [session, session.experiment] + list(session.experiment.page_set.all())
 		definition = json.loads(serializers.serialize('json', objs))
@@ -113,7 +116,8 @@ def session_experiment(request, session, subject):
 	else:
 		page_name = r.get('page:%s:%s:%s' % (instance, session.id, subject))
 		page = get_object_or_404(session.experiment.page_set, name=page_name)
-	return HttpResponse(page.render(context_instance=RequestContext(request)))
+	response = HttpResponse(page.render(context_instance=RequestContext(request)))
+	return set_token_cookie(response, session, subject)
 
 '''
 	An insecure hack to get around browser cross-site security.
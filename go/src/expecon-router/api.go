@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// SessionStatus is a view of a session taken in its loop.
+type SessionStatus struct {
+	Instance  string            `json:"instance"`
+	Session   int               `json:"session"`
+	Nonce     string            `json:"nonce"`
+	Subjects  []*SubjectStatus  `json:"subjects"`
+	Listeners []*ListenerStatus `json:"listeners"`
+}
+
+type SubjectStatus struct {
+	Name      string `json:"name"`
+	Period    int    `json:"period"`
+	Group     int    `json:"group"`
+	Page      string `json:"page"`
+	Connected bool   `json:"connected"`
+}
+
+type ListenerStatus struct {
+	Subject string `json:"subject"`
+	Role    string `json:"role"`
+	Queued  int    `json:"queued"` // messages waiting to be sent
+}
+
+// status runs in the session loop.
+func (s *Session) status() *SessionStatus {
+	status := &SessionStatus{
+		Instance:  s.instance,
+		Session:   s.id,
+		Nonce:     s.nonce,
+		Subjects:  make([]*SubjectStatus, 0, len(s.subjects)),
+		Listeners: make([]*ListenerStatus, 0, len(s.listeners)),
+	}
+	for _, name := range s.participants() {
+		subject := s.subjects[name]
+		_, connected := s.listeners[name]
+		status.Subjects = append(status.Subjects, &SubjectStatus{
+			Name:      name,
+			Period:    subject.period,
+			Group:     subject.group,
+			Page:      subject.page,
+			Connected: connected,
+		})
+	}
+	names := make([]string, 0, len(s.listeners))
+	for name := range s.listeners {
+		names = append(names, name)
+	}
+	sortSubjects(names)
+	for _, name := range names {
+		listener := s.listeners[name]
+		status.Listeners = append(status.Listeners, &ListenerStatus{
+			Subject: name,
+			Role:    listener.role.String(),
+			Queued:  listener.queue.Len(),
+		})
+	}
+	return status
+}
+
+// SessionStatus asks the loop of a session for its status, once it has
+// handled every message dispatched before.
+func (r *Router) SessionStatus(instance string, session_id int) *SessionStatus {
+	for {
+		session := r.Session(instance, session_id)
+		response := make(chan *SessionStatus, 1)
+		select {
+		case session.statusRequests <- response:
+			return <-response
+		case <-session.done:
+		}
+	}
+}
+
+// authorizeAPI accepts the secret itself as a bearer token, or an admin
+// token for the session if the request is about one.
+func (r *Router) authorizeAPI(req *http.Request, instance string, session_id int, sessionScoped bool) error {
+	if r.secret == nil {
+		return nil
+	}
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), r.secret) == 1 {
+		return nil
+	}
+	if !sessionScoped {
+		return errors.New("the secret is required")
+	}
+	return r.authorize(req, instance, session_id, "admin")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// ServeAPI dispatches the requests under /api/:
+//
+//	GET  /api/sessions
+//	GET  /api/subjects?instance=...&session=...
+//	GET  /api/listeners?instance=...&session=...
+//	POST /api/reset?instance=...&session=...
+//	POST /api/delete?instance=...&session=...
+//	POST /api/messages?instance=...&session=...   body: a message
+func (r *Router) ServeAPI(w http.ResponseWriter, req *http.Request) {
+	endpoint := strings.TrimPrefix(req.URL.Path, "/api/")
+	method := http.MethodPost
+	if endpoint == "sessions" || endpoint == "subjects" || endpoint == "listeners" {
+		method = http.MethodGet
+	}
+	switch endpoint {
+	case "sessions", "subjects", "listeners", "reset", "delete", "messages":
+	default:
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint %q", endpoint))
+		return
+	}
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs %s", endpoint, method))
+		return
+	}
+
+	if endpoint == "sessions" {
+		if err := r.authorizeAPI(req, "", 0, false); err != nil {
+			writeAPIError(w, http.StatusForbidden, err)
+			return
+		}
+		r.listSessions(w)
+		return
+	}
+
+	instance := req.URL.Query().Get("instance")
+	session_id, err := strconv.Atoi(req.URL.Query().Get("session"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("malformed session %q", req.URL.Query().Get("session")))
+		return
+	}
+	if err := r.authorizeAPI(req, instance, session_id, true); err != nil {
+		writeAPIError(w, http.StatusForbidden, err)
+		return
+	}
+	if !r.hasSession(instance, session_id) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("no session %s:%d", instance, session_id))
+		return
+	}
+
+	switch endpoint {
+	case "subjects":
+		writeJSON(w, http.StatusOK, r.SessionStatus(instance, session_id).Subjects)
+	case "listeners":
+		writeJSON(w, http.StatusOK, r.SessionStatus(instance, session_id).Listeners)
+	case "reset", "delete":
+		r.postMessage(w, instance, session_id, &Msg{Key: "__" + endpoint + "__"})
+	case "messages":
+		var msg Msg
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("malformed message: %v", err))
+			return
+		}
+		r.postMessage(w, instance, session_id, &msg)
+	}
+}
+
+func (r *Router) listSessions(w http.ResponseWriter) {
+	sessionIDs, err := r.db.SessionIDs()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sessions := make([]map[string]interface{}, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		sessions[i] = map[string]interface{}{"instance": sessionID.instance, "session": sessionID.id}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// postMessage hands msg to the session as if the admin had sent it. It is
+// handled asynchronously, errors are reported to the admin connections.
+func (r *Router) postMessage(w http.ResponseWriter, instance string, session_id int, msg *Msg) {
+	if msg.Key == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("missing key"))
+		return
+	}
+	if _, err := DecodePayload(msg); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%s: %v", msg.Key, err))
+		return
+	}
+	msg.Instance = instance
+	msg.Session = session_id
+	msg.Origin = ""
+	if msg.Sender == "" {
+		msg.Sender = "admin"
+	} else if msg.Sender != "admin" {
+		msg.Origin = "admin"
+	}
+	if msg.Nonce == "" {
+		msg.Nonce = r.Session(instance, session_id).Nonce()
+	}
+	r.Dispatch(msg)
+	writeJSON(w, http.StatusAccepted, map[string]string{"nonce": msg.Nonce})
+}
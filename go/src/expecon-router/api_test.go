@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{Secret: "secret"})
+	session := router.Session("redwood", 1)
+	router.RequestSubject("redwood", 1, "1")
+	router.RequestSubject("redwood", 1, "2")
+
+	call := func(method, path, body string, authorized bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorized {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeAPI(recorder, req)
+		return recorder
+	}
+	decode := func(response *httptest.ResponseRecorder, v interface{}) {
+		if response.Code/100 != 2 {
+			t.Fatalf("unexpected status %d: %s", response.Code, response.Body)
+		}
+		if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		method, path string
+		authorized   bool
+		status       int
+	}{
+		{"GET", "/api/sessions", false, http.StatusForbidden},
+		{"GET", "/api/subjects?instance=redwood&session=1", false, http.StatusForbidden},
+		{"POST", "/api/sessions", true, http.StatusMethodNotAllowed},
+		{"GET", "/api/subjects?instance=redwood&session=2", true, http.StatusNotFound},
+		{"GET", "/api/bogus", true, http.StatusNotFound},
+	} {
+		if response := call(c.method, c.path, "", c.authorized); response.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.status, response.Code)
+		}
+	}
+
+	var sessions []map[string]interface{}
+	decode(call("GET", "/api/sessions", "", true), &sessions)
+	if len(sessions) != 1 || sessions[0]["instance"] != "redwood" || sessions[0]["session"] != 1.0 {
+		t.Fatalf("unexpected sessions %v", sessions)
+	}
+
+	var accepted map[string]string
+	decode(call("POST", "/api/messages?instance=redwood&session=1",
+		`{"Key": "__set_page__", "Sender": "2", "Value": {"page": "Start"}}`, true), &accepted)
+	if accepted["nonce"] != session.Nonce() {
+		t.Fatalf("unexpected response %v", accepted)
+	}
+	if response := call("POST", "/api/messages?instance=redwood&session=1", `{"Key": "__set_period__"}`, true); response.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid payload, got %d", response.Code)
+	}
+
+	var subjects []*SubjectStatus
+	decode(call("GET", "/api/subjects?instance=redwood&session=1", "", true), &subjects)
+	if len(subjects) != 2 || subjects[1].Name != "2" || subjects[1].Page != "Start" || subjects[1].Connected {
+		t.Fatalf("unexpected subjects %+v", subjects)
+	}
+	var listeners []*ListenerStatus
+	decode(call("GET", "/api/listeners?instance=redwood&session=1", "", true), &listeners)
+	if len(listeners) != 0 {
+		t.Fatalf("unexpected listeners %+v", listeners)
+	}
+
+	nonce := session.Nonce()
+	decode(call("POST", "/api/reset?instance=redwood&session=1", "", true), &accepted)
+	router.SessionStatus("redwood", 1)
+	if session.Nonce() == nonce {
+		t.Fatal("session was not reset")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Barrier waits for every subject of its period and group to send __ready__
+// with its name, then the router sends the group a single __release__.
+type Barrier struct {
+	Name     string          `json:"name"`
+	Period   int             `json:"period"`
+	Group    int             `json:"group"`
+	Ready    map[string]bool `json:"ready"`
+	Released bool            `json:"released"`
+}
+
+// members lists the subjects the barrier waits for, in order.
+func (s *Session) members(period, group int) []string {
+	var members []string
+	for _, name := range s.participants() {
+		subject := s.subjects[name]
+		if subject.period == period && subject.group == group {
+			members = append(members, name)
+		}
+	}
+	return members
+}
+
+// ready marks subject ready for the barrier named by p and releases it if
+// the rest of the group is ready as well.
+func (s *Session) ready(msg *Msg, p *BarrierPayload) error {
+	subject, err := s.knownSubject(msg.Sender)
+	if err != nil {
+		return err
+	}
+	msg.Period, msg.Group = subject.period, subject.group
+	key := timerKey(p.Name, subject.period, subject.group)
+
+	s.lock.Lock()
+	barrier, exists := s.barriers[key]
+	if !exists {
+		barrier = &Barrier{Name: p.Name, Period: subject.period, Group: subject.group, Ready: make(map[string]bool)}
+		s.barriers[key] = barrier
+	}
+	barrier.Ready[subject.name] = true
+	s.lock.Unlock()
+	return s.saveBarriers()
+}
+
+// releaseBarriers releases every barrier whose members are all ready. It
+// runs after each message that may complete a barrier, including subjects
+// leaving a group.
+func (s *Session) releaseBarriers() error {
+	var released []*Barrier
+	s.lock.Lock()
+	for _, barrier := range s.barriers {
+		if barrier.Released {
+			continue
+		}
+		members := s.members(barrier.Period, barrier.Group)
+		complete := len(members) > 0
+		for _, name := range members {
+			complete = complete && barrier.Ready[name]
+		}
+		if complete {
+			barrier.Released = true
+			released = append(released, barrier)
+		}
+	}
+	s.lock.Unlock()
+	if len(released) == 0 {
+		return nil
+	}
+
+	if err := s.saveBarriers(); err != nil {
+		return err
+	}
+	for _, barrier := range released {
+		msg := &Msg{
+			Instance: s.instance,
+			Session:  s.id,
+			Nonce:    s.nonce,
+			Sender:   "server",
+			Period:   barrier.Period,
+			Group:    barrier.Group,
+			Time:     time.Now().UnixNano(),
+			Key:      "__release__",
+			Value:    map[string]interface{}{"name": barrier.Name, "subjects": s.members(barrier.Period, barrier.Group)},
+		}
+		if err := s.Receive(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) saveBarriers() error {
+	s.lock.RLock()
+	data, err := json.Marshal(s.barriers)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	objectID := SessionObjectID{objectType: "barriers", sessionID: SessionID{s.instance, s.id}}
+	return s.router.db.SetSessionObject(objectID, data)
+}
+
+func (s *Session) loadBarriers(data []byte) error {
+	barriers := make(map[string]*Barrier)
+	if err := json.Unmarshal(data, &barriers); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.barriers = barriers
+	s.lock.Unlock()
+	return nil
+}
+
+// Barriers lists the barriers of the given period and group, or all of
+// them. It is safe to call from outside the session loop.
+func (s *Session) Barriers(period, group int, all bool) []*Barrier {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	barriers := make([]*Barrier, 0)
+	for _, barrier := range s.barriers {
+		if all || (barrier.Period == period && barrier.Group == group) {
+			ready := make(map[string]bool, len(barrier.Ready))
+			for name := range barrier.Ready {
+				ready[name] = true
+			}
+			copied := *barrier
+			copied.Ready = ready
+			barriers = append(barriers, &copied)
+		}
+	}
+	return barriers
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func countReleases(t *testing.T, db Database) []string {
+	msgs, err := db.Messages(SessionID{"redwood", 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var released []string
+	for msg := range msgs {
+		if msg.Key == "__release__" {
+			value := msg.Value.(map[string]interface{})
+			released = append(released, fmt.Sprintf("%s/%d/%d/%v", value["name"], msg.Period, msg.Group, value["subjects"]))
+		}
+	}
+	return released
+}
+
+func TestBarrier(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	session := router.Session("redwood", 1)
+	nonce := session.Nonce()
+	send := func(sender, key string, value interface{}) {
+		router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: sender, Key: key, Value: value})
+	}
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprint(i)
+		router.RequestSubject("redwood", 1, name)
+		send(name, "__set_period__", map[string]int{"period": 1})
+		send(name, "__set_group__", map[string]int{"group": 1})
+	}
+
+	send("1", "__ready__", map[string]string{"name": "next"})
+	send("2", "__ready__", map[string]string{"name": "next"})
+	router.SessionStatus("redwood", 1)
+	if released := countReleases(t, db); len(released) != 0 {
+		t.Fatalf("released early: %v", released)
+	}
+	if barriers := session.Barriers(1, 1, false); len(barriers) != 1 || len(barriers[0].Ready) != 2 {
+		t.Fatalf("unexpected barriers %+v", barriers)
+	}
+
+	send("3", "__ready__", map[string]string{"name": "next"})
+	send("3", "__ready__", map[string]string{"name": "next"})
+	router.SessionStatus("redwood", 1)
+	if released := countReleases(t, db); fmt.Sprint(released) != "[next/1/1/[1 2 3]]" {
+		t.Fatalf("unexpected releases %v", released)
+	}
+
+	// a subject leaving the group no longer holds up the others
+	send("1", "__ready__", map[string]string{"name": "done"})
+	send("2", "__ready__", map[string]string{"name": "done"})
+	send("3", "__set_group__", map[string]int{"group": 2})
+	router.SessionStatus("redwood", 1)
+	if released := countReleases(t, db); len(released) != 2 || released[1] != "done/1/1/[1 2]" {
+		t.Fatalf("unexpected releases %v", released)
+	}
+
+	restarted := NewRouter(db, Options{}).Session("redwood", 1)
+	if barriers := restarted.Barriers(0, 0, true); len(barriers) != 2 || !barriers[0].Released || !barriers[1].Released {
+		t.Fatalf("unexpected barriers after restart %+v", barriers)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const indexEntrySize = 8
+
+// fileQueue is the open append-only log of a single session.
+type fileQueue struct {
+	log   *os.File
+	index *os.File
+	count int   // number of complete, indexed messages
+	size  int64 // length of the log covered by count
+}
+
+// FileDatabase keeps everything in a local directory, so the router can run
+// as a single binary without Redis. Each session has a directory
+// "<id>-<instance>" holding
+//
+//	messages.log   append-only queue, one JSON Msg per line
+//	messages.idx   big-endian int64 offset of each line
+//	objects.json   session objects keyed like Redis
+//	snapshot.json  latest snapshot of the queue
+type FileDatabase struct {
+	dir     string
+	lock    sync.Mutex
+	queues  map[SessionID]*fileQueue
+	objects map[SessionID]map[string][]byte
+}
+
+func NewFileDatabase(dir string) (*FileDatabase, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	database := &FileDatabase{
+		dir:     dir,
+		queues:  make(map[SessionID]*fileQueue),
+		objects: make(map[SessionID]map[string][]byte),
+	}
+	return database, nil
+}
+
+func (db *FileDatabase) sessionDir(sessionID SessionID) string {
+	name := fmt.Sprintf("%d-%s", sessionID.id, url.PathEscape(sessionID.instance))
+	return filepath.Join(db.dir, name)
+}
+
+func parseSessionDir(name string) (SessionID, error) {
+	components := strings.SplitN(name, "-", 2)
+	if len(components) != 2 {
+		return SessionID{}, errors.New("not a session directory: " + name)
+	}
+	id, err := strconv.Atoi(components[0])
+	if err != nil {
+		return SessionID{}, err
+	}
+	instance, err := url.PathUnescape(components[1])
+	if err != nil {
+		return SessionID{}, err
+	}
+	return SessionID{instance: instance, id: id}, nil
+}
+
+/* Getting/Setting Session Stuff */
+
+func (db *FileDatabase) SessionIDs() ([]SessionID, error) {
+	entries, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]SessionID, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// other directories, such as the archive of the redis store, can
+		// share the data dir
+		id, err := parseSessionDir(entry.Name())
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (db *FileDatabase) SessionObjectIDs(sessionID SessionID) ([]SessionObjectID, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	objects, err := db.sessionObjects(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]SessionObjectID, 0, len(objects))
+	for key := range objects {
+		components := strings.SplitN(key, ":", 4)
+		if len(components) != 4 {
+			return ids, errors.New("malformed session object key: " + key)
+		}
+		ids = append(ids, SessionObjectID{
+			objectType: components[0],
+			sessionID:  sessionID,
+			subject:    components[3],
+		})
+	}
+	return ids, nil
+}
+
+func (db *FileDatabase) DeleteSession(sessionID SessionID) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if queue, exists := db.queues[sessionID]; exists {
+		queue.log.Close()
+		queue.index.Close()
+		delete(db.queues, sessionID)
+	}
+	delete(db.objects, sessionID)
+	return os.RemoveAll(db.sessionDir(sessionID))
+}
+
+/* Getting and Setting Session Objects */
+
+// sessionObjects returns the cached contents of objects.json, reading it
+// from disk on first use. db.lock must be held.
+func (db *FileDatabase) sessionObjects(sessionID SessionID) (map[string][]byte, error) {
+	if objects, exists := db.objects[sessionID]; exists {
+		return objects, nil
+	}
+
+	objects := make(map[string][]byte)
+	data, err := ioutil.ReadFile(filepath.Join(db.sessionDir(sessionID), "objects.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var stored map[string]string
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+		for key, value := range stored {
+			objects[key] = []byte(value)
+		}
+	}
+	db.objects[sessionID] = objects
+	return objects, nil
+}
+
+func (db *FileDatabase) getData(objectID SessionObjectID) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	objects, err := db.sessionObjects(objectID.sessionID)
+	if err != nil {
+		return nil, err
+	}
+	data, exists := objects[objectID.Key()]
+	if !exists {
+		return nil, errors.New("session object does not exist: " + objectID.Key())
+	}
+	return data, nil
+}
+
+func (db *FileDatabase) getIntData(objectID SessionObjectID) (int, error) {
+	bytes, err := db.getData(objectID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes))
+}
+
+func (db *FileDatabase) Period(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID)
+}
+
+func (db *FileDatabase) Group(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID)
+}
+
+func (db *FileDatabase) Paused(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID)
+}
+
+func (db *FileDatabase) Config(objectID SessionObjectID) (*Msg, error) {
+	bytes, err := db.getData(objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Msg
+	err = json.Unmarshal(bytes, &config)
+	return &config, err
+}
+
+func (db *FileDatabase) SessionObject(objectID SessionObjectID) ([]byte, error) {
+	return db.getData(objectID)
+}
+
+func (db *FileDatabase) SetSessionObject(objectID SessionObjectID, data []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	objects, err := db.sessionObjects(objectID.sessionID)
+	if err != nil {
+		return err
+	}
+	objects[objectID.Key()] = append([]byte(nil), data...)
+
+	stored := make(map[string]string, len(objects))
+	for key, value := range objects {
+		stored[key] = string(value)
+	}
+	encoded, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return db.writeSidecar(objectID.sessionID, "objects.json", encoded)
+}
+
+// writeSidecar writes a whole file of the session directory then swaps it
+// in, so a crash never leaves a half written file behind.
+func (db *FileDatabase) writeSidecar(sessionID SessionID, name string, data []byte) error {
+	dir := db.sessionDir(sessionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+/* Opening Queues */
+
+// queue returns the open log for sessionID, opening (and if needed
+// repairing) it on first use. db.lock must be held.
+func (db *FileDatabase) queue(sessionID SessionID) (*fileQueue, error) {
+	if queue, exists := db.queues[sessionID]; exists {
+		return queue, nil
+	}
+
+	dir := db.sessionDir(sessionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, "messages.log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(filepath.Join(dir, "messages.idx"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	queue := &fileQueue{log: logFile, index: indexFile}
+	if err := queue.repair(); err != nil {
+		logFile.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	db.queues[sessionID] = queue
+	return queue, nil
+}
+
+// repair brings the index back in line with the log after an unclean
+// shutdown. Messages that made it to the log but not the index are
+// re-indexed, and a trailing partial line is truncated away.
+func (q *fileQueue) repair() error {
+	indexInfo, err := q.index.Stat()
+	if err != nil {
+		return err
+	}
+	logInfo, err := q.log.Stat()
+	if err != nil {
+		return err
+	}
+
+	q.count = int(indexInfo.Size() / indexEntrySize)
+	q.size = 0
+	// drop index entries that point past the end of the log
+	for q.count > 0 {
+		offset, err := q.offset(q.count - 1)
+		if err != nil {
+			return err
+		}
+		if offset < logInfo.Size() {
+			q.size = offset
+			break
+		}
+		q.count--
+	}
+
+	// rescan from the start of the last indexed message
+	if q.count > 0 {
+		q.count--
+	}
+	reader := bufio.NewReader(io.NewSectionReader(q.log, q.size, logInfo.Size()-q.size))
+	entry := make([]byte, indexEntrySize)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(entry, uint64(q.size))
+		if _, err := q.index.WriteAt(entry, int64(q.count)*indexEntrySize); err != nil {
+			return err
+		}
+		q.count++
+		q.size += int64(len(line))
+	}
+
+	if err := q.index.Truncate(int64(q.count) * indexEntrySize); err != nil {
+		return err
+	}
+	if err := q.log.Truncate(q.size); err != nil {
+		return err
+	}
+	if _, err := q.index.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err = q.log.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (q *fileQueue) offset(i int) (int64, error) {
+	return readOffset(q.index, i)
+}
+
+// readOffset returns the log offset of message i from an index file.
+func readOffset(index io.ReaderAt, i int) (int64, error) {
+	entry := make([]byte, indexEntrySize)
+	if _, err := index.ReadAt(entry, int64(i)*indexEntrySize); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(entry)), nil
+}
+
+/* Getting Messages */
+
+func (db *FileDatabase) Messages(sessionID SessionID, start int) (chan *Msg, error) {
+	// retrieve messages in smaller blocks to keep peak memory usage
+	// under control when the message digest gets too large
+	blockSize := 1000
+	messages := make(chan *Msg, blockSize)
+
+	db.lock.Lock()
+	if _, open := db.queues[sessionID]; !open {
+		// don't create an empty session just by reading it
+		_, err := os.Stat(filepath.Join(db.sessionDir(sessionID), "messages.log"))
+		if os.IsNotExist(err) {
+			db.lock.Unlock()
+			close(messages)
+			return messages, nil
+		}
+	}
+	queue, err := db.queue(sessionID)
+	if err != nil {
+		db.lock.Unlock()
+		return nil, err
+	}
+	// the log only grows, so everything up to count/size can be read
+	// without holding the lock while new messages are appended. The reader
+	// gets files of its own, which DeleteSession can't close under it.
+	messageCount, logSize := queue.count, queue.size
+	dir := db.sessionDir(sessionID)
+	logFile, err := os.Open(filepath.Join(dir, "messages.log"))
+	if err != nil {
+		db.lock.Unlock()
+		return nil, err
+	}
+	indexFile, err := os.Open(filepath.Join(dir, "messages.idx"))
+	db.lock.Unlock()
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer close(messages)
+		defer logFile.Close()
+		defer indexFile.Close()
+		for i := start; i < messageCount; i += blockSize {
+			limit := i + blockSize
+			if limit >= messageCount {
+				limit = messageCount
+			}
+			start, err := readOffset(indexFile, i)
+			if err != nil {
+				return
+			}
+			end := logSize
+			if limit < messageCount {
+				if end, err = readOffset(indexFile, limit); err != nil {
+					return
+				}
+			}
+			block := make([]byte, end-start)
+			if _, err := logFile.ReadAt(block, start); err != nil {
+				return
+			}
+			for _, line := range bytes.SplitAfter(block, []byte("\n")) {
+				if len(line) == 0 {
+					continue
+				}
+				var msg Msg
+				if err := json.Unmarshal(line, &msg); err != nil {
+					return
+				}
+				messages <- &msg
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+/* Saving Messages */
+
+// rollback drops whatever part of a message did get written to the log and
+// the index, so both end at the last complete message again.
+func (q *fileQueue) rollback() {
+	q.log.Truncate(q.size)
+	q.log.Seek(q.size, io.SeekStart)
+	indexSize := int64(q.count) * indexEntrySize
+	q.index.Truncate(indexSize)
+	q.index.Seek(indexSize, io.SeekStart)
+}
+
+func (db *FileDatabase) SaveMessage(msg *Msg) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	queue, err := db.queue(SessionID{instance: msg.Instance, id: msg.Session})
+	if err != nil {
+		return err
+	}
+
+	// the log is written before the index, so repair can always rebuild
+	// a missing index entry from a complete line
+	if _, err := queue.log.Write(b); err != nil {
+		queue.rollback()
+		return err
+	}
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(entry, uint64(queue.size))
+	if _, err := queue.index.Write(entry); err != nil {
+		queue.rollback()
+		return err
+	}
+	queue.count++
+	queue.size += int64(len(b))
+	return nil
+}
+
+/* Compaction */
+
+func (db *FileDatabase) Snapshot(sessionID SessionID) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(db.sessionDir(sessionID), "snapshot.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	err = json.Unmarshal(data, &snapshot)
+	return &snapshot, err
+}
+
+// SaveSnapshot leaves messages.log alone, it already is the archive.
+func (db *FileDatabase) SaveSnapshot(sessionID SessionID, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.writeSidecar(sessionID, "snapshot.json", data)
+}
+
+// Count returns the number of messages in the queue of sessionID.
+func (db *FileDatabase) Count(sessionID SessionID) (int, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	queue, err := db.queue(sessionID)
+	if err != nil {
+		return 0, err
+	}
+	return queue.count, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// MemoryDatabase keeps nothing across router restarts, it is meant for
+// pilot sessions and tests.
+type MemoryDatabase struct {
+	lock sync.RWMutex
+	// messages are kept encoded so readers always get their own copy,
+	// just as they would from Redis
+	queues    map[SessionID][][]byte
+	objects   map[SessionID]map[SessionObjectID][]byte
+	snapshots map[SessionID][]byte
+}
+
+func NewMemoryDatabase() (database *MemoryDatabase) {
+	database = &MemoryDatabase{
+		queues:    make(map[SessionID][][]byte),
+		objects:   make(map[SessionID]map[SessionObjectID][]byte),
+		snapshots: make(map[SessionID][]byte),
+	}
+	return database
+}
+
+/* Getting/Setting Session Stuff */
+
+func (db *MemoryDatabase) SessionIDs() ([]SessionID, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	ids := make([]SessionID, 0, len(db.queues))
+	for id := range db.queues {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (db *MemoryDatabase) SessionObjectIDs(sessionID SessionID) ([]SessionObjectID, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	objects := db.objects[sessionID]
+	ids := make([]SessionObjectID, 0, len(objects))
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (db *MemoryDatabase) DeleteSession(sessionID SessionID) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	delete(db.queues, sessionID)
+	delete(db.objects, sessionID)
+	delete(db.snapshots, sessionID)
+	return nil
+}
+
+/* Getting and Setting Session Objects */
+
+func (db *MemoryDatabase) getData(objectID SessionObjectID) ([]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	data, exists := db.objects[objectID.sessionID][objectID]
+	if !exists {
+		return nil, errors.New("session object does not exist: " + objectID.Key())
+	}
+	return data, nil
+}
+
+func (db *MemoryDatabase) getIntData(objectID SessionObjectID) (int, error) {
+	bytes, err := db.getData(objectID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes))
+}
+
+func (db *MemoryDatabase) Period(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID)
+}
+
+func (db *MemoryDatabase) Group(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID)
+}
+
+func (db *MemoryDatabase) Paused(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID)
+}
+
+func (db *MemoryDatabase) Config(objectID SessionObjectID) (*Msg, error) {
+	bytes, err := db.getData(objectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Msg
+	err = json.Unmarshal(bytes, &config)
+	return &config, err
+}
+
+func (db *MemoryDatabase) SessionObject(objectID SessionObjectID) ([]byte, error) {
+	return db.getData(objectID)
+}
+
+func (db *MemoryDatabase) SetSessionObject(objectID SessionObjectID, data []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	objects, exists := db.objects[objectID.sessionID]
+	if !exists {
+		objects = make(map[SessionObjectID][]byte)
+		db.objects[objectID.sessionID] = objects
+	}
+	objects[objectID] = append([]byte(nil), data...)
+	return nil
+}
+
+/* Getting Messages */
+
+func (db *MemoryDatabase) Messages(sessionID SessionID, start int) (chan *Msg, error) {
+	db.lock.RLock()
+	queue := db.queues[sessionID]
+	db.lock.RUnlock()
+	if start < len(queue) {
+		queue = queue[start:]
+	} else {
+		queue = nil
+	}
+
+	// queue only ever grows by appending, so this slice header is a
+	// consistent snapshot even while new messages are being saved
+	messages := make(chan *Msg, 1000)
+	go func() {
+		defer close(messages)
+		for _, bytes := range queue {
+			var msg Msg
+			if err := json.Unmarshal(bytes, &msg); err != nil {
+				return
+			}
+			messages <- &msg
+		}
+	}()
+
+	return messages, nil
+}
+
+/* Saving Messages */
+
+func (db *MemoryDatabase) SaveMessage(msg *Msg) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sessionID := SessionID{instance: msg.Instance, id: msg.Session}
+	db.lock.Lock()
+	db.queues[sessionID] = append(db.queues[sessionID], b)
+	db.lock.Unlock()
+	return nil
+}
+
+/* Compaction */
+
+func (db *MemoryDatabase) Snapshot(sessionID SessionID) (*Snapshot, error) {
+	db.lock.RLock()
+	data, exists := db.snapshots[sessionID]
+	db.lock.RUnlock()
+	if !exists {
+		return nil, nil
+	}
+	var snapshot Snapshot
+	err := json.Unmarshal(data, &snapshot)
+	return &snapshot, err
+}
+
+// SaveSnapshot keeps the whole queue, there is nothing to archive it to.
+func (db *MemoryDatabase) SaveSnapshot(sessionID SessionID, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.snapshots[sessionID] = data
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"redis-go"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisDatabase can move the messages replaced by a snapshot out of Redis
+// into a file archive. Queue indices stay the same: the first
+// session_archived:<instance>:<id> messages of a queue are read from the
+// archive, the rest from the list.
+type RedisDatabase struct {
+	client *redis.Client
+	// nil if messages are never archived
+	archive *FileDatabase
+	// held exclusively while messages are moved to the archive, so readers
+	// never see the list shift under them
+	archiveLock sync.RWMutex
+}
+
+func NewRedisDatabase(redisHost string, redisDB int) (database *RedisDatabase) {
+	database = &RedisDatabase{
+		client: &redis.Client{Addr: redisHost, Db: redisDB},
+	}
+	return database
+}
+
+// SetArchive makes SaveSnapshot move the messages a snapshot covers from
+// Redis into archive.
+func (db *RedisDatabase) SetArchive(archive *FileDatabase) {
+	db.archive = archive
+}
+
+// SetObserver has observe called after every Redis command with its
+// latency and error.
+func (db *RedisDatabase) SetObserver(observe func(cmd string, elapsed time.Duration, err error)) {
+	db.client.Observe = observe
+}
+
+/* Getting/Setting Session Stuff */
+
+func (db *RedisDatabase) SessionIDs() ([]SessionID, error) {
+	sessionsData, err := db.client.Smembers("sessions")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]SessionID, len(sessionsData))
+
+	for i, bytes := range sessionsData {
+		components := strings.Split(string(bytes), ":")
+
+		instance := components[1]
+		id, err := strconv.Atoi(components[2])
+		if err != nil {
+			return ids, err
+		}
+
+		ids[i] = SessionID{
+			instance: instance,
+			id:       id,
+		}
+	}
+	return ids, err
+}
+
+func (db *RedisDatabase) SessionObjectIDs(sessionID SessionID) ([]SessionObjectID, error) {
+	key := sessionID.ObjectsKey()
+	sessionObjects, err := db.client.Smembers(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]SessionObjectID, len(sessionObjects))
+
+	for i, bytes := range sessionObjects {
+		components := strings.Split(string(bytes), ":")
+
+		objectType := components[0]
+		instance := components[1]
+		id, err := strconv.Atoi(components[2])
+		if err != nil {
+			return ids, err
+		}
+		if instance != sessionID.instance || id != sessionID.id {
+			return ids, errors.New("session_objs has object with different instance/id")
+		}
+		subject := components[3]
+
+		ids[i] = SessionObjectID{
+			objectType: objectType,
+			sessionID: SessionID{
+				instance: instance,
+				id:       id,
+			},
+			subject: subject,
+		}
+	}
+	return ids, err
+}
+
+func (db *RedisDatabase) DeleteSession(sessionID SessionID) error {
+	db.archiveLock.Lock()
+	defer db.archiveLock.Unlock()
+	for _, key := range []string{sessionID.Key(), sessionID.SnapshotKey(), sessionID.ArchivedKey()} {
+		if _, err := db.client.Del(key); err != nil {
+			return err
+		}
+	}
+	if db.archive != nil {
+		if err := db.archive.DeleteSession(sessionID); err != nil {
+			return err
+		}
+	}
+	_, err := db.client.Srem("sessions", []byte(sessionID.Key()))
+	if err != nil {
+		return err
+	}
+	return db.DeleteSessionObjects(sessionID)
+}
+
+/* Getting and Setting Session Objects */
+
+func (db *RedisDatabase) getIntData(key string) (int, error) {
+	bytes, err := db.client.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes))
+}
+
+func (db *RedisDatabase) Period(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID.Key())
+}
+
+func (db *RedisDatabase) Group(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID.Key())
+}
+
+func (db *RedisDatabase) Paused(objectID SessionObjectID) (int, error) {
+	return db.getIntData(objectID.Key())
+}
+
+func (db *RedisDatabase) Config(objectID SessionObjectID) (*Msg, error) {
+	bytes, err := db.client.Get(objectID.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	var config Msg
+	err = json.Unmarshal(bytes, &config)
+	return &config, err
+}
+
+func (db *RedisDatabase) SessionObject(objectID SessionObjectID) ([]byte, error) {
+	return db.client.Get(objectID.Key())
+}
+
+func (db *RedisDatabase) SetSessionObject(objectID SessionObjectID, data []byte) error {
+	keyBytes := []byte(objectID.Key())
+
+	var err error
+	if err = db.client.Set(objectID.Key(), data); err != nil {
+		return err
+	}
+	if _, err = db.client.Sadd(objectID.sessionID.ObjectsKey(), keyBytes); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *RedisDatabase) DeleteSessionObjects(sessionID SessionID) error {
+	objectKeys, err := db.client.Smembers(sessionID.ObjectsKey())
+	if err != nil {
+		return err
+	}
+	for i := range objectKeys {
+		_, err := db.client.Del(string(objectKeys[i]))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.client.Del(sessionID.ObjectsKey())
+	return err
+}
+
+/* Getting Messages */
+
+// archived returns the number of messages of sessionID that have been
+// moved to the archive. db.archiveLock must be held.
+func (db *RedisDatabase) archived(sessionID SessionID) (int, error) {
+	if db.archive == nil {
+		return 0, nil
+	}
+	bytes, err := db.client.Get(sessionID.ArchivedKey())
+	if err != nil {
+		// not archived yet
+		return 0, nil
+	}
+	return strconv.Atoi(string(bytes))
+}
+
+// readArchive sends messages start up to end of the archive of sessionID
+// to messages.
+func (db *RedisDatabase) readArchive(sessionID SessionID, start, end int, messages chan *Msg) error {
+	archived, err := db.archive.Messages(sessionID, start)
+	if err != nil {
+		return err
+	}
+	// drain the whole channel so the reader doesn't block forever
+	for i := start; ; i++ {
+		msg, ok := <-archived
+		if !ok {
+			if i < end {
+				return fmt.Errorf("archive of %s ends at %d, expected %d", sessionID.Key(), i, end)
+			}
+			return nil
+		}
+		if i < end {
+			messages <- msg
+		}
+	}
+}
+
+func (db *RedisDatabase) Messages(sessionID SessionID, start int) (chan *Msg, error) {
+	// retrieve messages in smaller blocks to keep peak memory usage
+	// under control when the message digest gets too large
+	blockSize := 1000
+	db.archiveLock.RLock()
+	archived, err := db.archived(sessionID)
+	var listLength int
+	if err == nil {
+		listLength, err = db.client.Llen(sessionID.Key())
+	}
+	db.archiveLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	messageCount := archived + listLength
+
+	messages := make(chan *Msg, blockSize)
+
+	log.Printf("Fetching %d messages from Redis into %p", messageCount, messages)
+	go func() {
+		defer close(messages)
+		for i := start; i < messageCount; i += blockSize {
+			limit := i + blockSize
+			if limit >= messageCount {
+				limit = messageCount
+			}
+			db.archiveLock.RLock()
+			archived, err := db.archived(sessionID)
+			var msgData [][]byte
+			if err == nil && limit > archived {
+				from := i - archived
+				if from < 0 {
+					from = 0
+				}
+				msgData, err = db.client.Lrange(sessionID.Key(), from, limit-archived-1)
+			}
+			db.archiveLock.RUnlock()
+			if err != nil {
+				return
+			}
+			if i < archived {
+				end := archived
+				if end > limit {
+					end = limit
+				}
+				if err := db.readArchive(sessionID, i, end, messages); err != nil {
+					log.Print(err)
+					return
+				}
+			}
+			for _, bytes := range msgData {
+				var msg Msg
+				if err = json.Unmarshal(bytes, &msg); err != nil {
+					return
+				}
+				messages <- &msg
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+/* Saving Messages */
+
+func (db *RedisDatabase) SaveMessage(msg *Msg) error {
+	key := fmt.Sprintf("session:%s:%d", msg.Instance, msg.Session)
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := db.client.Sadd("sessions", []byte(key)); err != nil {
+		return err
+	}
+	return db.client.Rpush(key, b)
+}
+
+/* Compaction */
+
+func (db *RedisDatabase) Snapshot(sessionID SessionID) (*Snapshot, error) {
+	bytes, err := db.client.Get(sessionID.SnapshotKey())
+	if err != nil {
+		// no snapshot yet
+		return nil, nil
+	}
+	var snapshot Snapshot
+	err = json.Unmarshal(bytes, &snapshot)
+	return &snapshot, err
+}
+
+func (db *RedisDatabase) SaveSnapshot(sessionID SessionID, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := db.client.Set(sessionID.SnapshotKey(), data); err != nil {
+		return err
+	}
+	if db.archive == nil {
+		return nil
+	}
+
+	db.archiveLock.Lock()
+	defer db.archiveLock.Unlock()
+	archived, err := db.archived(sessionID)
+	if err != nil {
+		return err
+	}
+	// the archive can be ahead of session_archived if an earlier move was
+	// interrupted before the list was trimmed
+	copied, err := db.archive.Count(sessionID)
+	if err != nil {
+		return err
+	}
+	if copied < archived {
+		return fmt.Errorf("archive of %s has %d messages, expected %d", sessionID.Key(), copied, archived)
+	}
+	if snapshot.Index <= archived {
+		return nil
+	}
+	msgData, err := db.client.Lrange(sessionID.Key(), copied-archived, snapshot.Index-archived-1)
+	if err != nil {
+		return err
+	}
+	for _, bytes := range msgData {
+		var msg Msg
+		if err := json.Unmarshal(bytes, &msg); err != nil {
+			return err
+		}
+		msg.Instance, msg.Session = sessionID.instance, sessionID.id
+		if err := db.archive.SaveMessage(&msg); err != nil {
+			return err
+		}
+	}
+	if err := db.client.Ltrim(sessionID.Key(), snapshot.Index-archived, -1); err != nil {
+		return err
+	}
+	_, err = db.client.Incrby(sessionID.ArchivedKey(), int64(snapshot.Index-archived))
+	return err
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func saveTestMessages(t *testing.T, db Database, sessionID SessionID, count int) {
+	for i := 0; i < count; i++ {
+		msg := &Msg{
+			Instance: sessionID.instance,
+			Session:  sessionID.id,
+			Sender:   "1",
+			Time:     int64(i),
+			Key:      "foo",
+			Value:    fmt.Sprintf("bar%d", i),
+		}
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTestMessages(t *testing.T, db Database, sessionID SessionID, count int) {
+	checkTestMessagesFrom(t, db, sessionID, 0, count)
+}
+
+func checkTestMessagesFrom(t *testing.T, db Database, sessionID SessionID, start, count int) {
+	messages, err := db.Messages(sessionID, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := start
+	for msg := range messages {
+		if msg.Time != int64(i) || msg.Value != fmt.Sprintf("bar%d", i) {
+			t.Fatalf("message %d out of order: %+v", i, msg)
+		}
+		i++
+	}
+	expected := count - start
+	if expected < 0 {
+		expected = 0
+	}
+	if i-start != expected {
+		t.Fatalf("expected %d messages from %d, got %d", expected, start, i-start)
+	}
+}
+
+func testDatabase(t *testing.T, db Database) {
+	sessionID := SessionID{instance: "redwood", id: 1}
+	// more than one block of messages
+	saveTestMessages(t, db, sessionID, 2500)
+	checkTestMessages(t, db, sessionID, 2500)
+	checkTestMessagesFrom(t, db, sessionID, 1500, 2500)
+	checkTestMessagesFrom(t, db, sessionID, 3000, 2500)
+
+	ids, err := db.SessionIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != sessionID {
+		t.Fatalf("unexpected session ids %v", ids)
+	}
+
+	objectID := SessionObjectID{objectType: "period", sessionID: sessionID, subject: "1"}
+	if err := db.SetSessionObject(objectID, []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if period, err := db.Period(objectID); err != nil || period != 3 {
+		t.Fatalf("expected period 3, got %d (%v)", period, err)
+	}
+	objectIDs, err := db.SessionObjectIDs(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objectIDs) != 1 || objectIDs[0] != objectID {
+		t.Fatalf("unexpected session object ids %v", objectIDs)
+	}
+
+	if snapshot, err := db.Snapshot(sessionID); err != nil || snapshot != nil {
+		t.Fatalf("expected no snapshot, got %v (%v)", snapshot, err)
+	}
+	if err := db.SaveSnapshot(sessionID, &Snapshot{Index: 2000, Messages: []*Msg{{Key: "foo"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, err := db.Snapshot(sessionID); err != nil || snapshot.Index != 2000 || len(snapshot.Messages) != 1 {
+		t.Fatalf("unexpected snapshot %+v (%v)", snapshot, err)
+	}
+	// the queue itself is kept for export
+	checkTestMessages(t, db, sessionID, 2500)
+
+	if err := db.DeleteSession(sessionID); err != nil {
+		t.Fatal(err)
+	}
+	checkTestMessages(t, db, sessionID, 0)
+	if snapshot, err := db.Snapshot(sessionID); err != nil || snapshot != nil {
+		t.Fatalf("snapshot survived DeleteSession: %v (%v)", snapshot, err)
+	}
+	if _, err := db.Period(objectID); err == nil {
+		t.Fatal("session object survived DeleteSession")
+	}
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	testDatabase(t, NewMemoryDatabase())
+}
+
+func TestFileDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redwood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, db)
+}
+
+func TestFileDatabaseRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redwood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := SessionID{instance: "", id: 7}
+	saveTestMessages(t, db, sessionID, 10)
+
+	// simulate a crash: the last index entry and half a line never made it
+	sessionDir := db.sessionDir(sessionID)
+	if err := os.Truncate(filepath.Join(sessionDir, "messages.idx"), 9*indexEntrySize); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(sessionDir, "messages.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"Key":"tor`))
+	f.Close()
+
+	reopened, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestMessages(t, reopened, sessionID, 10)
+	saveTestMessages(t, reopened, SessionID{instance: "", id: 8}, 1)
+	// the redis store keeps its archive in the same data dir
+	if err := os.Mkdir(filepath.Join(dir, "archive"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := reopened.SessionIDs()
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("expected 2 sessions, got %v (%v)", ids, err)
+	}
+}
+
+func TestFileDatabaseRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redwood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := SessionID{instance: "", id: 7}
+	saveTestMessages(t, db, sessionID, 10)
+
+	// make the index write fail after the line has been logged
+	queue := db.queues[sessionID]
+	readOnly, err := os.Open(filepath.Join(db.sessionDir(sessionID), "messages.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.index.Close()
+	queue.index = readOnly
+	if err := db.SaveMessage(&Msg{Session: 7, Sender: "1", Key: "lost"}); err == nil {
+		t.Fatal("expected the index write to fail")
+	}
+	if info, err := queue.log.Stat(); err != nil || info.Size() != queue.size {
+		t.Fatalf("log left at %v bytes, expected %d (%v)", info.Size(), queue.size, err)
+	}
+
+	reopened, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestMessages(t, reopened, sessionID, 10)
+}
+
+// A reader started before DeleteSession still gets the whole queue
+func TestFileDatabaseDeleteWhileReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redwood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := SessionID{instance: "", id: 7}
+	saveTestMessages(t, db, sessionID, 2500)
+
+	messages, err := db.Messages(sessionID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reader can't be more than a block ahead
+	<-messages
+	if err := db.DeleteSession(sessionID); err != nil {
+		t.Fatal(err)
+	}
+	count := 1
+	for range messages {
+		count++
+	}
+	if count != 2500 {
+		t.Fatalf("expected 2500 messages, got %d", count)
+	}
+}
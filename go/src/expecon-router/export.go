@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exportHeader is the header of to_csv.py. Every field nested in a Value
+// gets a column of its own after it, named by its path like build_header
+// does, e.g. Value.bids.0.
+var exportHeader = []string{"Period", "Group", "Sender", "Origin", "Time", "ClientTime", "Sealed", "Submitted", "Key", "Value"}
+
+// ExportFilter selects the messages to export. Empty fields match every
+// message.
+type ExportFilter struct {
+	Keys     map[string]bool
+	Subjects map[string]bool
+	Period   int
+	Group    int
+}
+
+func (f *ExportFilter) Match(msg *Msg) bool {
+	return (len(f.Keys) == 0 || f.Keys[msg.Key]) &&
+		(len(f.Subjects) == 0 || f.Subjects[msg.Sender]) &&
+		(f.Period == 0 || msg.Period == f.Period) &&
+		(f.Group == 0 || msg.Group == f.Group)
+}
+
+// exportTable collects flattened messages, adding a column for each nested
+// field the first time it is seen.
+type exportTable struct {
+	columns []string
+	index   map[string]int
+	rows    [][]string
+	numbers [][]int64 // the numeric columns of each row, for Parquet
+}
+
+// the columns of exportHeader written as INT64 to Parquet
+var exportNumbers = []string{"Period", "Group", "Time", "ClientTime", "Submitted"}
+
+func newExportTable() *exportTable {
+	t := &exportTable{index: make(map[string]int)}
+	for _, column := range exportHeader {
+		t.column(column)
+	}
+	return t
+}
+
+func (t *exportTable) column(name string) int {
+	i, exists := t.index[name]
+	if !exists {
+		i = len(t.columns)
+		t.index[name] = i
+		t.columns = append(t.columns, name)
+	}
+	return i
+}
+
+func (t *exportTable) add(msg *Msg) {
+	row := make([]string, len(t.columns))
+	set := func(column, value string) {
+		i := t.column(column)
+		for len(row) <= i {
+			row = append(row, "")
+		}
+		row[i] = value
+	}
+	// ClientTime is a uint64, Parquet INT64 keeps its bits
+	t.numbers = append(t.numbers, []int64{int64(msg.Period), int64(msg.Group), msg.Time, int64(msg.ClientTime), msg.Submitted})
+	set("Period", strconv.Itoa(msg.Period))
+	set("Group", strconv.Itoa(msg.Group))
+	set("Sender", msg.Sender)
+	set("Origin", msg.Origin)
+	set("Time", strconv.FormatInt(msg.Time, 10))
+	set("ClientTime", strconv.FormatUint(msg.ClientTime, 10))
+	set("Sealed", msg.Sealed)
+	set("Submitted", strconv.FormatInt(msg.Submitted, 10))
+	set("Key", msg.Key)
+	// like to_csv.py, leave the config csv out
+	if msg.Key != "__set_config__" {
+		flattenValue("Value", msg.Value, set)
+	}
+	t.rows = append(t.rows, row)
+}
+
+// flattenValue passes every scalar nested in v to set, named by its path.
+// Objects and lists themselves have no value.
+func flattenValue(path string, v interface{}, set func(column, value string)) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flattenValue(path+"."+key, v[key], set)
+		}
+	case []interface{}:
+		for i, element := range v {
+			flattenValue(path+"."+strconv.Itoa(i), element, set)
+		}
+	case nil:
+		set(path, "")
+	case string:
+		set(path, v)
+	case float64:
+		set(path, strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		bytes, _ := json.Marshal(v)
+		set(path, string(bytes))
+	}
+}
+
+// padded returns the rows with one cell for every column.
+func (t *exportTable) padded() [][]string {
+	for i, row := range t.rows {
+		for len(row) < len(t.columns) {
+			row = append(row, "")
+		}
+		t.rows[i] = row
+	}
+	return t.rows
+}
+
+func (t *exportTable) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write(t.columns)
+	writer.WriteAll(t.padded())
+	return writer.Error()
+}
+
+// writeParquet writes the table with the numeric columns of the header as
+// INT64 and everything else as strings.
+func (t *exportTable) writeParquet(w io.Writer) error {
+	rows := t.padded()
+	numbers := make(map[string]int)
+	for i, name := range exportNumbers {
+		numbers[name] = i
+	}
+	columns := make([]*ParquetColumn, len(t.columns))
+	for i, name := range t.columns {
+		column := &ParquetColumn{Name: name}
+		if n, exists := numbers[name]; exists {
+			column.Ints = make([]int64, len(rows))
+			for j := range rows {
+				column.Ints[j] = t.numbers[j][n]
+			}
+		} else {
+			column.Strings = make([]string, len(rows))
+			for j, row := range rows {
+				column.Strings[j] = row[i]
+			}
+		}
+		columns[i] = column
+	}
+	return WriteParquet(w, columns, len(rows))
+}
+
+// Export writes the messages of a session matching filter to w in format,
+// one of csv, jsonl or parquet.
+func Export(db Database, sessionID SessionID, filter *ExportFilter, format string, w io.Writer) error {
+	switch format {
+	case "csv", "jsonl", "parquet":
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	messages, err := db.Messages(sessionID, 0)
+	if err != nil {
+		return err
+	}
+
+	if format == "jsonl" {
+		encoder := json.NewEncoder(w)
+		for msg := range messages {
+			if filter.Match(msg) {
+				if err := encoder.Encode(msg); err != nil {
+					// drain the channel so the reader doesn't block forever
+					for range messages {
+					}
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	table := newExportTable()
+	for msg := range messages {
+		if filter.Match(msg) {
+			table.add(msg)
+		}
+	}
+	if format == "csv" {
+		return table.writeCSV(w)
+	}
+	return table.writeParquet(w)
+}
+
+// splitList parses a comma separated flag into a set.
+func splitList(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// runExport implements the export subcommand, which reads a session
+// straight from a storage backend, without the web app:
+//
+//	expecon-router export -store file -data redwood-data -session 12 -format csv -o session-12.csv
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	store := flags.String("store", "redis", "Storage backend: redis, file or memory")
+	redis_host := flags.String("redis", "127.0.0.1:6379", "Redis server")
+	redis_db := flags.Int("db", 0, "Redis db")
+	data_dir := flags.String("data", "redwood-data", "Data directory of the file store or the Redis archive")
+	instance := flags.String("instance", "", "Instance prefix of the session, as in the router url")
+	session_id := flags.Int("session", 0, "Session to export")
+	format := flags.String("format", "csv", "Output format: csv, jsonl or parquet")
+	output := flags.String("o", "", "Output file (default stdout)")
+	keys := flags.String("key", "", "Only export these comma separated keys")
+	subjects := flags.String("subject", "", "Only export messages from these comma separated subjects")
+	filter := &ExportFilter{}
+	flags.IntVar(&filter.Period, "period", 0, "Only export this period (0 for all)")
+	flags.IntVar(&filter.Group, "group", 0, "Only export this group (0 for all)")
+	flags.Parse(args)
+	filter.Keys = splitList(*keys)
+	filter.Subjects = splitList(*subjects)
+
+	if *session_id == 0 {
+		return fmt.Errorf("export needs a -session")
+	}
+	db, err := NewDatabase(*store, *redis_host, *redis_db, *data_dir)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return Export(db, SessionID{*instance, *session_id}, filter, *format, w)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func exportFixture(t *testing.T) Database {
+	db := NewMemoryDatabase()
+	for _, msg := range []*Msg{
+		{Sender: "admin", Key: "__set_config__", Value: "period,group\n1,1"},
+		{Sender: "1", Period: 1, Group: 1, Time: 10, Key: "bid", Value: map[string]interface{}{"price": 2.5, "items": []interface{}{"a", "b"}}},
+		{Sender: "2", Origin: "admin", Period: 1, Group: 2, Time: 20, Key: "bid", Value: map[string]interface{}{"price": 3.0}},
+		{Sender: "1", Period: 2, Group: 1, Time: 30, Key: "chat", Value: "hello"},
+	} {
+		msg.Instance = "redwood"
+		msg.Session = 1
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestExportCSV(t *testing.T) {
+	db := exportFixture(t)
+	var out bytes.Buffer
+	if err := Export(db, SessionID{"redwood", 1}, &ExportFilter{}, "csv", &out); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"Period", "Group", "Sender", "Origin", "Time", "ClientTime", "Sealed", "Submitted", "Key", "Value", "Value.items.0", "Value.items.1", "Value.price"},
+		{"0", "0", "admin", "", "0", "0", "", "0", "__set_config__", "", "", "", ""},
+		{"1", "1", "1", "", "10", "0", "", "0", "bid", "", "a", "b", "2.5"},
+		{"1", "2", "2", "admin", "20", "0", "", "0", "bid", "", "", "", "3"},
+		{"2", "1", "1", "", "30", "0", "", "0", "chat", "hello", "", "", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("unexpected csv\n%v", rows)
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	db := exportFixture(t)
+	for _, c := range []struct {
+		filter *ExportFilter
+		times  []int64
+	}{
+		{&ExportFilter{Keys: splitList("bid")}, []int64{10, 20}},
+		{&ExportFilter{Subjects: splitList("1, 2")}, []int64{10, 20, 30}},
+		{&ExportFilter{Period: 1, Group: 2}, []int64{20}},
+		{&ExportFilter{Keys: splitList("bid,chat"), Subjects: splitList("1")}, []int64{10, 30}},
+	} {
+		var out bytes.Buffer
+		if err := Export(db, SessionID{"redwood", 1}, c.filter, "jsonl", &out); err != nil {
+			t.Fatal(err)
+		}
+		var times []int64
+		decoder := json.NewDecoder(&out)
+		for decoder.More() {
+			var msg Msg
+			if err := decoder.Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+			times = append(times, msg.Time)
+		}
+		if !reflect.DeepEqual(times, c.times) {
+			t.Errorf("filter %+v exported %v, expected %v", c.filter, times, c.times)
+		}
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	db := exportFixture(t)
+	var out bytes.Buffer
+	if err := Export(db, SessionID{"redwood", 1}, &ExportFilter{Keys: splitList("bid")}, "parquet", &out); err != nil {
+		t.Fatal(err)
+	}
+	file := out.Bytes()
+	if !bytes.HasPrefix(file, []byte("PAR1")) || !bytes.HasSuffix(file, []byte("PAR1")) {
+		t.Fatal("missing magic")
+	}
+	footer := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if footer <= 0 || footer > len(file)-12 {
+		t.Fatalf("bad footer length %d", footer)
+	}
+	meta := string(file[len(file)-8-footer : len(file)-8])
+	for _, column := range []string{"Period", "Sender", "Value.items.1", "Value.price"} {
+		if !strings.Contains(meta, column) {
+			t.Errorf("column %s missing from the metadata", column)
+		}
+	}
+	// the Sender page holds both senders as length prefixed strings
+	if !bytes.Contains(file, []byte("\x01\x00\x00\x001\x01\x00\x00\x002")) {
+		t.Error("Sender column not found")
+	}
+}
+
+func TestExportUnknownFormat(t *testing.T) {
+	if err := Export(exportFixture(t), SessionID{"redwood", 1}, &ExportFilter{}, "xlsx", &bytes.Buffer{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
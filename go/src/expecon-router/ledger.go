@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Account is the ledger entry of one subject. The ledger is kept as the
+// "ledger" session object, so payouts don't have to be reconstructed by
+// scanning the queue.
+type Account struct {
+	Points            map[int]float64 `json:"points"`      // by period
+	Paid              map[int]bool    `json:"paid"`        // by period
+	LotteryPays       map[int]float64 `json:"lottery_pay"` // by period
+	ConversionRate    float64         `json:"conversion_rate"`
+	ShowUpFee         float64         `json:"show_up_fee"`
+	LotteryConversion float64         `json:"lottery_conversion"`
+}
+
+func NewAccount() *Account {
+	return &Account{
+		Points:            make(map[int]float64),
+		Paid:              make(map[int]bool),
+		LotteryPays:       make(map[int]float64),
+		ConversionRate:    1,
+		LotteryConversion: 1,
+	}
+}
+
+// Payout is an Account with its totals.
+type Payout struct {
+	Subject string `json:"subject"`
+	*Account
+	TotalPoints float64 `json:"total_points"`
+	PaidPoints  float64 `json:"paid_points"`
+	BasePay     float64 `json:"base_pay"`
+	LotteryPay  float64 `json:"total_lottery_pay"`
+	TotalPay    float64 `json:"total_pay"`
+}
+
+func (a *Account) payout(subject string) *Payout {
+	payout := &Payout{Subject: subject, Account: a}
+	for period, points := range a.Points {
+		payout.TotalPoints += points
+		if a.Paid[period] {
+			payout.PaidPoints += points
+		}
+	}
+	payout.BasePay = payout.PaidPoints * a.ConversionRate
+	for _, pay := range a.LotteryPays {
+		payout.LotteryPay += pay * a.LotteryConversion
+	}
+	payout.TotalPay = payout.BasePay + a.ShowUpFee + payout.LotteryPay
+	return payout
+}
+
+// account returns the ledger entry of the named subject. s.lock must be
+// held.
+func (s *Session) account(name string) (*Account, error) {
+	if _, err := s.knownSubject(name); err != nil {
+		return nil, err
+	}
+	if RoleFor(name) != RoleSubject {
+		return nil, fmt.Errorf("%s has no account", name)
+	}
+	account, exists := s.ledger[name]
+	if !exists {
+		account = NewAccount()
+		s.ledger[name] = account
+	}
+	return account, nil
+}
+
+// book records the payoff keys in the ledger.
+func (s *Session) book(msg *Msg, payload Payload) error {
+	s.lock.Lock()
+	account, err := s.account(msg.Sender)
+	if err == nil {
+		switch p := payload.(type) {
+		case *SetPointsPayload:
+			if math.IsNaN(*p.Points) || math.IsInf(*p.Points, 0) {
+				err = fmt.Errorf("points %v are not a number", *p.Points)
+				break
+			}
+			account.Points[*p.Period] = *p.Points
+		case *MarkPaidPayload:
+			if _, exists := account.Points[*p.Period]; !exists {
+				err = fmt.Errorf("%s has no points in period %d", msg.Sender, *p.Period)
+				break
+			}
+			account.Paid[*p.Period] = *p.Paid
+		case *AmountPayload:
+			switch p.field {
+			case "conversion_rate":
+				account.ConversionRate = *p.Amount
+			case "show_up_fee":
+				account.ShowUpFee = *p.Amount
+			case "lottery_conversion":
+				account.LotteryConversion = *p.Amount
+			case "lottery_pay":
+				account.LotteryPays[*p.Period] = *p.Amount
+			}
+		}
+	}
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(s.ledger)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	objectID := SessionObjectID{objectType: "ledger", sessionID: SessionID{s.instance, s.id}}
+	return s.router.db.SetSessionObject(objectID, data)
+}
+
+func (s *Session) loadLedger(data []byte) error {
+	ledger := make(map[string]*Account)
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.ledger = ledger
+	s.lock.Unlock()
+	return nil
+}
+
+// Payouts returns the ledger of subject, or of every subject in order. It
+// is safe to call from outside the session loop.
+func (s *Session) Payouts(subject string, all bool) []*Payout {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := make([]string, 0, len(s.ledger))
+	for name := range s.ledger {
+		if all || name == subject {
+			names = append(names, name)
+		}
+	}
+	sortSubjects(names)
+	payouts := make([]*Payout, len(names))
+	for i, name := range names {
+		payouts[i] = s.ledger[name].payout(name)
+	}
+	return payouts
+}
+
+// getLedger answers a __get_ledger__ request. Subjects only get their own
+// account.
+func (l *Listener) getLedger() {
+	session := l.router.Session(l.instance, l.session_id)
+	response := &Msg{
+		Instance: l.instance,
+		Session:  l.session_id,
+		Nonce:    session.Nonce(),
+		Sender:   "server",
+		Time:     time.Now().UnixNano(),
+		Key:      "__ledger__",
+		Value:    session.Payouts(l.subject.name, l.role != RoleSubject),
+	}
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	l.Send(response, bytes)
+}
+
+// ServeLedger serves the payouts of a session as JSON. With a secret the
+// request needs an admin or listener token for the session.
+func (r *Router) ServeLedger(w http.ResponseWriter, req *http.Request) {
+	instance := req.URL.Query().Get("instance")
+	session_id, err := strconv.Atoi(req.URL.Query().Get("session"))
+	if err != nil {
+		http.Error(w, "malformed session", http.StatusBadRequest)
+		return
+	}
+	if err := r.authorize(req, instance, session_id, "admin", "listener"); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !r.hasSession(instance, session_id) {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+	payouts := r.Session(instance, session_id).Payouts("", true)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payouts)
+}
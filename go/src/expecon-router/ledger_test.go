@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{Secret: "secret"})
+	session := router.Session("redwood", 1)
+	router.RequestSubject("redwood", 1, "1")
+	nonce := session.Nonce()
+	send := func(key string, value interface{}) {
+		router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Key: key, Value: value})
+	}
+	send("__set_points__", map[string]interface{}{"period": 1, "points": 10})
+	send("__set_points__", map[string]interface{}{"period": 2, "points": 5})
+	send("__mark_paid__", map[string]interface{}{"period": 1, "paid": true})
+	// no points to pay in period 3
+	send("__mark_paid__", map[string]interface{}{"period": 3, "paid": true})
+	send("__set_conversion_rate__", map[string]interface{}{"conversion_rate": 2})
+	send("__set_show_up_fee__", map[string]interface{}{"show_up_fee": 5})
+	router.SessionStatus("redwood", 1)
+
+	payouts := session.Payouts("1", false)
+	if len(payouts) != 1 {
+		t.Fatalf("expected 1 payout, got %d", len(payouts))
+	}
+	payout := payouts[0]
+	if payout.TotalPoints != 15 || payout.PaidPoints != 10 || payout.TotalPay != 25 || len(payout.Paid) != 1 {
+		t.Fatalf("unexpected payout %+v", payout)
+	}
+
+	restarted := NewRouter(db, Options{}).Session("redwood", 1)
+	if reloaded := restarted.Payouts("", true); len(reloaded) != 1 || reloaded[0].TotalPay != 25 {
+		t.Fatalf("unexpected payouts after restart %+v", reloaded)
+	}
+
+	get := func(token string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeLedger(recorder, httptest.NewRequest("GET", "/ledger?instance=redwood&session=1&token="+token, nil))
+		return recorder
+	}
+	if response := get(""); response.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without a token, got %d", response.Code)
+	}
+	subjectToken, _ := SignToken([]byte("secret"), &TokenClaims{Instance: "redwood", Session: 1, Subject: "1", Expires: time.Now().Add(time.Hour).Unix()})
+	if response := get(subjectToken); response.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a subject token, got %d", response.Code)
+	}
+	token, _ := SignToken([]byte("secret"), &TokenClaims{Instance: "redwood", Session: 1, Subject: "listener", Expires: time.Now().Add(time.Hour).Unix()})
+	response := get(token)
+	var served []*Payout
+	if err := json.NewDecoder(response.Body).Decode(&served); err != nil || response.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %v", response.Code, err)
+	}
+	if len(served) != 1 || served[0].Subject != "1" || served[0].TotalPay != 25 {
+		t.Fatalf("unexpected payouts %+v", served)
+	}
+}
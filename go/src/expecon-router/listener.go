@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"time"
 	"websocket"
@@ -12,50 +13,57 @@ type Listener struct {
 	instance   string
 	session_id int
 	subject    *Subject
-	recv       chan []byte
+	role       Role
+	queue      *SendQueue
 	conn       *websocket.Conn
 	encoder    *json.Encoder
 	decoder    *json.Decoder
+	lastPong   int64 // UnixNano, accessed atomically
 }
 
-func NewListener(router *Router, instance string, session_id int, subject *Subject, connection *websocket.Conn) *Listener {
+func NewListener(router *Router, instance string, session_id int, subject *Subject, role Role, overflow OverflowPolicy, connection *websocket.Conn) *Listener {
 	listener := &Listener{
 		router:     router,
 		instance:   instance,
 		session_id: session_id,
 		subject:    subject,
-		recv:       make(chan []byte, 100),
+		role:       role,
+		queue:      NewSendQueue(router.queueSize, overflow),
 		conn:       connection,
 		encoder:    json.NewEncoder(connection),
 		decoder:    json.NewDecoder(connection),
 	}
+	connection.OnPong = listener.pong
 	return listener
 }
 
-// send msg to the given Listener
-// If it fails for any reason, l is added to the remove queue.
-func (l *Listener) Send(rawMessage []byte) {
-	if l.router.removeListeners != nil {
-		defer func() {
-			// If send on l.recv fails, then remove the listener
-			if err := recover(); err != nil {
-				l.router.removeListeners <- l
-			}
-		}()
-	}
-	l.recv <- rawMessage
+// send msg, encoded as rawMessage, to the given Listener without blocking
+// If it fails for any reason, false is returned and l should be removed.
+func (l *Listener) Send(msg *Msg, rawMessage []byte) bool {
+	return l.queue.Push(msg, rawMessage)
 }
 
 func (l *Listener) SendLoop() {
 	defer func() {
-		close(l.recv)
+		if dropped := l.queue.Dropped(); dropped > 0 {
+			log.Printf("%s/%d/%s: dropped %d messages", l.instance, l.session_id, l.subject.name, dropped)
+		}
 	}()
 	for {
-		msg, ok := <-l.recv
+		msg, reason, ok := l.queue.Pop()
 		if !ok {
+			if reason != "" {
+				log.Printf("disconnecting %s/%d/%s: %s", l.instance, l.session_id, l.subject.name, reason)
+				status := websocket.CloseStatusPolicyViolation
+				if reason == ShutdownReason {
+					status = websocket.CloseStatusGoingAway
+				}
+				l.conn.CloseWithReason(status, reason)
+			}
 			return
 		}
 		if _, err := l.conn.Write(msg); err != nil {
+			l.queue.Close()
 			return
 		}
 	}
@@ -69,74 +77,161 @@ func (l *Listener) ReceiveLoop() {
 		}
 		msg.Instance = l.instance
 		msg.Session = l.session_id
-		if msg.Sender == "" && l.subject.name != "" {
+		// only admins send on behalf of others, everyone else always sends
+		// as themselves and is routed by their own period and group
+		msg.Origin = ""
+		if msg.Sender == "" || !policies[l.role].delegate {
 			msg.Sender = l.subject.name
+		} else if msg.Sender != l.subject.name {
+			msg.Origin = l.subject.name
+		}
+		if msg.Key == "__router_status__" {
+			// pings of old pages, the router keeps connections alive itself
+			continue
+		}
+		if !policies[l.role].CanSend(msg.Key) {
+			l.router.ReportError(l.instance, l.session_id, l.subject.name, fmt.Errorf("%s: not permitted for %s connections", msg.Key, l.role))
+			continue
+		}
+		if msg.Override && !policies[l.role].override {
+			l.router.ReportError(l.instance, l.session_id, l.subject.name, fmt.Errorf("%s: %s connections may not override period and group", msg.Key, l.role))
+			continue
 		}
 		switch msg.Key {
 		case "__get_period__":
-			v := msg.Value.(map[string]interface{})
-			period := int(v["period"].(float64))
-			msgs := make([]*Msg, 0)
-
-			allMessages, err := l.router.db.Messages(SessionID{l.instance, l.session_id})
-			if err != nil {
-				log.Fatal(err)
+			if err := l.getPeriod(&msg); err != nil {
+				l.router.ReportError(l.instance, l.session_id, l.subject.name, fmt.Errorf("__get_period__: %v", err))
 			}
-			for msg := range allMessages {
-				if period == 0 || msg.Period == period {
-					msgs = append(msgs, msg)
-				}
-			}
-			bytes, err := json.Marshal(&Msg{Key: "__get_period__", Value: msgs})
-			if err != nil {
-				log.Fatal("could not marshal __get_period__ message")
-			}
-			l.recv <- bytes
+		case "__get_ledger__":
+			l.getLedger()
 		default:
-			l.router.messages <- &msg
+			l.router.Dispatch(&msg)
 		}
 	}
 }
 
+// getPeriod answers a __get_period__ request with every message sent in the
+// requested period, or the whole queue for period 0, leaving out messages
+// the listener may not see.
+func (l *Listener) getPeriod(msg *Msg) error {
+	payload, err := DecodePayload(msg)
+	if err != nil {
+		return err
+	}
+	period := *payload.(*PeriodPayload).Period
+	msgs := make([]*Msg, 0)
+
+	allMessages, err := l.router.db.Messages(SessionID{l.instance, l.session_id}, 0)
+	if err != nil {
+		return err
+	}
+	for msg := range allMessages {
+		if (period == 0 || msg.Period == period) && (policies[l.role].receiveAll || l.visible(msg)) {
+			msgs = append(msgs, msg)
+		}
+	}
+	response := &Msg{Key: "__get_period__", Value: msgs}
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	l.Send(response, bytes)
+	return nil
+}
+
+// SyncCursor is where a reconnecting client left off: the nonce of the
+// session it was synced with, and the Time or queue index of the last
+// message it saw.
+type SyncCursor struct {
+	Nonce string
+	Since int64 // Time of the last message seen
+	Index int   // queue index after the last message seen, as given in __queue_end__
+}
+
 // push requested messages from queue to w, in between to fictitious start and end messages
-func (l *Listener) Sync() {
+// With a cursor from the current session only messages after it are sent,
+// if the session has been reset since then everything is replayed.
+func (l *Listener) Sync(cursor *SyncCursor) {
+	started, sent := time.Now(), 0
 	session := l.router.Session(l.instance, l.session_id)
+	sessionID := SessionID{l.instance, l.session_id}
+	nonce := session.Nonce()
+
+	resumed := cursor != nil && cursor.Nonce == nonce
+	start, since := 0, int64(0)
+	if resumed {
+		start, since = cursor.Index, cursor.Since
+	}
 
 	queueStartMessage := &Msg{
 		Time:  time.Now().UnixNano(),
 		Key:   "__queue_start__",
-		Nonce: session.nonce,
+		Nonce: nonce,
+		Value: map[string]interface{}{
+			"resumed": resumed,
+			// so pages learn about pending pauses without digging through the queue
+			"paused":   session.PausedSubjects(l.subject.name, l.role != RoleSubject),
+			"timers":   session.RunningTimers(l.subject.period, l.subject.group, l.role != RoleSubject),
+			"barriers": session.Barriers(l.subject.period, l.subject.group, l.role != RoleSubject),
+			"presence": l.presence(session),
+		},
 	}
 	l.encoder.Encode(queueStartMessage)
 
-	messages, err := l.router.db.Messages(SessionID{l.instance, l.session_id})
+	// replay the compacted part of the queue from its snapshot
+	index := start
+	snapshot, err := l.router.db.Snapshot(sessionID)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("sync from snapshot failed, replaying the whole queue: %v", err)
+	} else if snapshot != nil && start < snapshot.Index {
+		for _, msg := range snapshot.Messages {
+			if msg.Time > since && l.match(session, msg) {
+				l.encoder.Encode(msg)
+				sent++
+			}
+		}
+		index = snapshot.Index
 	}
-	for msg := range messages {
-		if l.match(session, msg) {
-			l.encoder.Encode(&msg)
+
+	messages, err := l.router.db.Messages(sessionID, index)
+	if err != nil {
+		// still close the queue so the client isn't left waiting
+		l.router.ReportError(l.instance, l.session_id, l.subject.name, fmt.Errorf("sync: %v", err))
+	} else {
+		for msg := range messages {
+			index++
+			if msg.Time > since && l.match(session, msg) {
+				l.encoder.Encode(&msg)
+				sent++
+			}
 		}
 	}
 
 	queueEndMessage := &Msg{
 		Time:  time.Now().UnixNano(),
 		Key:   "__queue_end__",
-		Nonce: session.nonce,
+		Nonce: nonce,
+		Value: map[string]interface{}{"index": index},
 	}
 	l.encoder.Encode(queueEndMessage)
+	l.router.metrics.Synced(time.Since(started), sent)
 	log.Printf("Finished sync for %p", l)
 }
 
+// visible reports whether a subject listener may see msg at all, leaving
+// out messages directed at others and sealed messages of others.
+func (l *Listener) visible(msg *Msg) bool {
+	return msg.AddressedTo(l.subject.name) && (msg.Sealed == "" || msg.Sender == l.subject.name)
+}
+
 func (l *Listener) match(session *Session, msg *Msg) bool {
-	if l.subject.name == "listener" {
+	// admin needs to receive everything, e.g. for the redwood 2 admin
+	// pause controls
+	if policies[l.role].receiveAll {
 		return true
 	}
-	// keeping this for backwards compatibility reasons
-	// otherwise admin doesn't receive everything
-	// needed for redwood 2 admin pause controls and other things
-	if l.subject.name == "admin" {
-		return true
+	if !l.visible(msg) {
+		return false
 	}
 	//
 	control :=
@@ -149,7 +244,7 @@ func (l *Listener) match(session *Session, msg *Msg) bool {
 		msg.Key == "__set_period__" ||
 			msg.Key == "__set_group__" ||
 			msg.Key == "__set_page__"
-	is_admin := l.subject.name == "admin"
+	is_admin := l.role == RoleAdmin
 	same_period := msg.Period == l.subject.period || msg.Period == 0
 	same_group := msg.Group == l.subject.group || msg.Group == 0
 	session.lock.RLock()
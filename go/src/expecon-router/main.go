@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 	"websocket"
 )
 
@@ -21,8 +23,31 @@ import (
 type Subject struct {
 	name          string
 	period, group int
+	page          string
 }
 
+// Options configure a router started with StartUp.
+type Options struct {
+	Port int
+	// HMAC secret shared with the Django app to sign connection tokens.
+	// If empty, connections are not authenticated.
+	Secret string
+	// Messages queued per listener before Overflow applies.
+	QueueSize int
+	// What to do when a listener's queue is full, unless the client asks
+	// for a different policy with the "overflow" query parameter.
+	Overflow OverflowPolicy
+	// How often session queues are compacted into snapshots, 0 disables it.
+	CompactInterval time.Duration
+	// How often connections are pinged, those missing three pings in a
+	// row are dropped. 0 disables heartbeats.
+	HeartbeatInterval time.Duration
+	// How long a shutdown waits for connections to drain.
+	ShutdownTimeout time.Duration
+}
+
+const DefaultQueueSize = 100
+
 type SubjectRequest struct {
 	instance string
 	session  int
@@ -31,14 +56,32 @@ type SubjectRequest struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var help bool
+	var store string
 	var redis_host string
 	var redis_db int
-	var port int
+	var data_dir string
+	var overflow string
+	var options Options
 	flag.BoolVar(&help, "h", false, "Print this usage message")
+	flag.StringVar(&store, "store", "redis", "Storage backend: redis, file or memory")
 	flag.StringVar(&redis_host, "redis", "127.0.0.1:6379", "Redis server")
 	flag.IntVar(&redis_db, "db", 0, "Redis db")
-	flag.IntVar(&port, "port", 8080, "Listen port")
+	flag.StringVar(&data_dir, "data", "redwood-data", "Data directory for the file store and the Redis archive")
+	flag.IntVar(&options.Port, "port", 8080, "Listen port")
+	flag.StringVar(&options.Secret, "secret", "", "Shared secret for signed connection tokens (empty disables authentication)")
+	flag.IntVar(&options.QueueSize, "queue", DefaultQueueSize, "Messages buffered per connection")
+	flag.DurationVar(&options.CompactInterval, "compact", 10*time.Minute, "How often to snapshot session queues (0 disables compaction)")
+	flag.DurationVar(&options.HeartbeatInterval, "heartbeat", 15*time.Second, "How often to ping connections (0 disables heartbeats)")
+	flag.DurationVar(&options.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to wait for connections to drain on SIGTERM")
+	flag.StringVar(&overflow, "overflow", DropOldest.String(), "Policy when a connection's buffer is full: drop-oldest, coalesce or disconnect")
 	flag.Parse()
 
 	if help {
@@ -46,27 +89,51 @@ func main() {
 		return
 	}
 
-	StartUp(redis_host, redis_db, port, nil)
+	var err error
+	if options.Overflow, err = ParseOverflowPolicy(overflow); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := NewDatabase(store, redis_host, redis_db, data_dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	StartUp(db, options, nil)
 }
 
-func StartUp(redis_host string, redis_db, port int, ready chan bool) {
+func StartUp(db Database, options Options, ready chan bool) {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	router := NewRouter(redis_host, redis_db)
-	go router.Route()
-	log.Println("router routing")
-	websocketHandler := websocket.Handler(func(c *websocket.Conn) {
-		router.HandleWebsocket(c)
-		c.Close()
-	})
+	router := NewRouter(db, options)
+	if options.Secret == "" {
+		log.Println("no -secret given, connections will not be authenticated")
+	}
+	if options.CompactInterval > 0 {
+		go router.CompactLoop(options.CompactInterval)
+	}
+	websocketHandler := websocket.Server{
+		Handshake: router.HandshakeWebsocket,
+		Handler: func(c *websocket.Conn) {
+			router.HandleWebsocket(c)
+			c.Close()
+		},
+	}
+	http.HandleFunc("/ledger", router.ServeLedger)
+	http.HandleFunc("/api/", router.ServeAPI)
+	http.HandleFunc("/metrics", router.ServeMetrics)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		websocketHandler.ServeHTTP(w, r)
 	})
-	log.Printf("listening on port %d", port)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", options.Port)}
+	stopped := make(chan struct{})
+	go shutdownOnSignal(server, router, options, stopped)
+	log.Printf("listening on port %d", options.Port)
 	if ready != nil {
 		ready <- true
 	}
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		log.Panicln(err)
 	}
+	<-stopped
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"redis-go"
 	"sync"
 	"testing"
 	"time"
@@ -12,26 +11,34 @@ import (
 )
 
 var once sync.Once
-var redisHost = "127.0.0.1:6379"
-var redisDB = 1
+var testDB = NewMemoryDatabase()
 
 func flushDB() {
-	client := &redis.Client{Addr: redisHost, Db: redisDB}
-	client.Flush(false)
+	testDB.lock.Lock()
+	defer testDB.lock.Unlock()
+	testDB.queues = make(map[SessionID][][]byte)
+	testDB.objects = make(map[SessionID]map[SessionObjectID][]byte)
+	testDB.snapshots = make(map[SessionID][]byte)
 }
 
 func setupRouter() {
 	once.Do(func() {
 		ready := make(chan bool)
-		go StartUp(redisHost, redisDB, 8080, ready)
+		// the flood tests count every message they sent, so the queues get
+		// room for a whole flood instead of dropping, see queue_test.go
+		go StartUp(testDB, Options{Port: 8080}, ready)
 		<-ready
 	})
 }
 
 func setupClient(clientID int) (*websocket.Conn, error) {
+	return dialSession(1, fmt.Sprint(clientID))
+}
+
+func dialSession(session int, name string) (*websocket.Conn, error) {
 	var ws *websocket.Conn
 	var err error
-	url := fmt.Sprintf("ws://127.0.0.1:8080/redwood/1/%d", clientID)
+	url := fmt.Sprintf("ws://127.0.0.1:8080/redwood/%d/%s", session, name)
 	for timeout := 1; ; timeout *= 2 {
 		ws, err = websocket.Dial(url, "", "http://127.0.0.1")
 		if err == nil {
@@ -118,7 +125,8 @@ func TestSync(t *testing.T) {
 		go func(i int) {
 			conn, err := setupClient(i)
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			d := json.NewDecoder(conn)
 			for j := 0; j < msg_count; j++ {
@@ -138,13 +146,329 @@ func TestSync(t *testing.T) {
 	}
 }
 
+// connect a client and read through its initial sync, returning the nonce
+func syncClient(t *testing.T, clientID int) (*websocket.Conn, *json.Decoder, string) {
+	return syncSession(t, 1, fmt.Sprint(clientID))
+}
+
+func syncSession(t *testing.T, session int, name string) (*websocket.Conn, *json.Decoder, string) {
+	conn, err := dialSession(session, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := json.NewDecoder(conn)
+	var nonce string
+	for {
+		var msg Msg
+		if err := d.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Key == "__queue_start__" {
+			nonce = msg.Nonce
+		}
+		if msg.Key == "__queue_end__" {
+			return conn, d, nonce
+		}
+	}
+}
+
+// wait for the next __error__ message, failing if a message with key
+// forbidden is delivered first
+func expectError(t *testing.T, d *json.Decoder, forbidden string) {
+	for {
+		var msg Msg
+		if err := d.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Key == "__error__" {
+			return
+		}
+		if msg.Key == forbidden {
+			t.Fatalf("%s was delivered: %+v", forbidden, msg)
+		}
+	}
+}
+
+// Malformed control messages are reported back instead of crashing the router
+func TestMalformedControlMessage(t *testing.T) {
+	flushDB()
+	setupRouter()
+	conn, d, nonce := syncClient(t, 5000)
+	defer conn.Close()
+	e := json.NewEncoder(conn)
+	for _, value := range []interface{}{"oops", map[string]interface{}{"period": "one"}} {
+		if err := e.Encode(Msg{Nonce: nonce, Key: "__set_period__", Value: value}); err != nil {
+			t.Fatal(err)
+		}
+		expectError(t, d, "__set_period__")
+	}
+}
+
+// Subjects may not reset the session
+func TestSubjectCannotReset(t *testing.T) {
+	flushDB()
+	setupRouter()
+	conn, d, nonce := syncClient(t, 5001)
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(Msg{Nonce: nonce, Key: "__reset__"}); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, d, "__reset__")
+
+	other, _, otherNonce := syncClient(t, 5002)
+	defer other.Close()
+	if otherNonce != nonce {
+		t.Fatal("session was reset by a subject")
+	}
+}
+
+// Pings of old pages are ignored rather than reported as not permitted
+func TestRouterStatusIgnored(t *testing.T) {
+	flushDB()
+	setupRouter()
+	conn, d, nonce := syncClient(t, 5003)
+	defer conn.Close()
+	e := json.NewEncoder(conn)
+	if err := e.Encode(Msg{Nonce: nonce, Key: "__router_status__", Value: map[string]bool{"connected": true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(Msg{Nonce: nonce, Key: "after_ping", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var msg Msg
+		if err := d.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Key == "__error__" {
+			t.Fatalf("ping reported: %v", msg.Value)
+		}
+		if msg.Key == "after_ping" {
+			break
+		}
+	}
+}
+
+// Deleting a session replaces it without disturbing other sessions
+func TestDeleteSession(t *testing.T) {
+	flushDB()
+	setupRouter()
+	other, otherDecoder, otherNonce := syncSession(t, 3, "1")
+	defer other.Close()
+
+	admin, _, nonce := syncSession(t, 2, "admin")
+	if err := json.NewEncoder(admin).Encode(Msg{Nonce: nonce, Key: "__delete__"}); err != nil {
+		t.Fatal(err)
+	}
+	admin.Close()
+	for {
+		conn, _, newNonce := syncSession(t, 2, "1")
+		conn.Close()
+		if newNonce != nonce {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := json.NewEncoder(other).Encode(Msg{Nonce: otherNonce, Key: "still_here", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var msg Msg
+		if err := otherDecoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Key == "still_here" {
+			break
+		}
+	}
+}
+
+// read messages until one with key arrives
+func expectKey(t *testing.T, d *json.Decoder, key string) *Msg {
+	for {
+		var msg Msg
+		if err := d.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Key == key {
+			return &msg
+		}
+	}
+}
+
+// Reconnecting with a cursor replays only newer messages
+func TestResumeSync(t *testing.T) {
+	flushDB()
+	setupRouter()
+	conn, d, nonce := syncSession(t, 4, "1")
+	e := json.NewEncoder(conn)
+	for _, key := range []string{"first", "second"} {
+		if err := e.Encode(Msg{Nonce: nonce, Key: key, Value: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := expectKey(t, d, "first")
+	expectKey(t, d, "second")
+	conn.Close()
+
+	// the query string rides along with the subject name
+	for _, test := range []struct {
+		nonce   string
+		resumed bool
+		keys    []string
+	}{
+		{nonce, true, []string{"second"}},
+		{"stale", false, []string{"first", "second"}},
+	} {
+		conn, err := dialSession(4, fmt.Sprintf("1?nonce=%s&since=%d", test.nonce, first.Time))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := json.NewDecoder(conn)
+		start := expectKey(t, d, "__queue_start__")
+		if resumed := start.Value.(map[string]interface{})["resumed"]; resumed != test.resumed {
+			t.Errorf("nonce %s: expected resumed %v, got %v", test.nonce, test.resumed, resumed)
+		}
+		keys := syncKeys(t, d)
+		conn.Close()
+		if fmt.Sprint(keys) != fmt.Sprint(test.keys) {
+			t.Errorf("nonce %s: expected %v, got %v", test.nonce, test.keys, keys)
+		}
+	}
+}
+
+// read the keys of the unreserved messages of a sync
+func syncKeys(t *testing.T, d *json.Decoder) []string {
+	var keys []string
+	for {
+		var msg Msg
+		if err := d.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Key == "__queue_end__" {
+			return keys
+		}
+		if !IsReservedKey(msg.Key) {
+			keys = append(keys, msg.Key)
+		}
+	}
+}
+
+// Sync replays the snapshot instead of the queue it covers
+func TestSyncFromSnapshot(t *testing.T) {
+	flushDB()
+	setupRouter()
+	conn, d, nonce := syncSession(t, 6, "1")
+	defer conn.Close()
+	e := json.NewEncoder(conn)
+	if err := e.Encode(Msg{Nonce: nonce, Key: "compacted", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	expectKey(t, d, "compacted")
+
+	sessionID := SessionID{instance: "redwood", id: 6}
+	messages, err := testDB.Messages(sessionID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for range messages {
+		count++
+	}
+	snapshot := &Snapshot{Index: count, Messages: []*Msg{{Key: "from_snapshot", Time: 1}}}
+	if err := testDB.SaveSnapshot(sessionID, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(Msg{Nonce: nonce, Key: "tail", Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	expectKey(t, d, "tail")
+
+	other, err := dialSession(6, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if keys := syncKeys(t, json.NewDecoder(other)); fmt.Sprint(keys) != "[from_snapshot tail]" {
+		t.Fatalf("unexpected sync %v", keys)
+	}
+}
+
+// Paused subjects can't send experiment messages until they are resumed
+func TestPause(t *testing.T) {
+	flushDB()
+	setupRouter()
+	subject, subjectDecoder, nonce := syncSession(t, 7, "1")
+	defer subject.Close()
+	admin, adminDecoder, _ := syncSession(t, 7, "admin")
+	defer admin.Close()
+	subjectEncoder := json.NewEncoder(subject)
+	adminEncoder := json.NewEncoder(admin)
+
+	send := func(e *json.Encoder, key string, value interface{}) {
+		if err := e.Encode(Msg{Nonce: nonce, Sender: "1", Key: key, Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(subjectEncoder, "__set_period__", map[string]int{"period": 1})
+	expectKey(t, subjectDecoder, "__set_period__")
+	send(adminEncoder, "__pause__", map[string]int{"period": 1})
+	expectKey(t, adminDecoder, "__pause__")
+
+	send(subjectEncoder, "bid", 1)
+	expectError(t, subjectDecoder, "bid")
+
+	// neither its own acknowledgement nor reserved keys get the subject
+	// around the pause, the __paused__ after them shows they were handled
+	send(subjectEncoder, "__resumed__", map[string]int{"period": 1})
+	send(subjectEncoder, "bid", 3)
+	send(subjectEncoder, "__set_group__", map[string]int{"group": 2})
+	send(subjectEncoder, "__paused__", map[string]int{"period": 1})
+	expectKey(t, subjectDecoder, "__resumed__")
+	for {
+		var msg Msg
+		if err := subjectDecoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Key == "__paused__" {
+			break
+		}
+		if msg.Key == "bid" || msg.Key == "__set_group__" {
+			t.Fatalf("%s of a paused subject was delivered", msg.Key)
+		}
+	}
+
+	observer, err := dialSession(7, "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := expectKey(t, json.NewDecoder(observer), "__queue_start__")
+	observer.Close()
+	if paused := start.Value.(map[string]interface{})["paused"]; fmt.Sprint(paused) != "map[1:1]" {
+		t.Errorf("unexpected pause state %v", paused)
+	}
+
+	send(adminEncoder, "__resume__", map[string]int{"period": 1})
+	expectKey(t, subjectDecoder, "__resume__")
+	send(subjectEncoder, "bid", 2)
+	if msg := expectKey(t, subjectDecoder, "bid"); msg.Value != 2.0 {
+		t.Fatalf("unexpected bid %+v", msg)
+	}
+}
+
 func TestIntegration(t *testing.T) {
 	flushDB()
 	setupRouter()
 	var wg sync.WaitGroup
 	for i := 1; i <= 10; i++ {
 		wg.Add(1)
-		go func(i int) { floodRouter(i, "foo", "bar", 10000); wg.Done() }(i)
+		go func(i int) {
+			defer wg.Done()
+			if err := floodRouter(i, "foo", "bar", 10000); err != nil {
+				t.Error(err)
+			}
+		}(i)
 	}
 	wg.Wait()
 }
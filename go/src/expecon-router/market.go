@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Kinds of market.
+const (
+	MarketFirstPrice  = "first_price"
+	MarketSecondPrice = "second_price"
+	MarketDouble      = "double_auction"
+)
+
+type Order struct {
+	ID       int     `json:"id"`
+	Subject  string  `json:"subject"`
+	Price    float64 `json:"price"`
+	Quantity int     `json:"quantity"`
+	Time     int64   `json:"time"`
+}
+
+type Trade struct {
+	Buyer    string  `json:"buyer"`
+	Seller   string  `json:"seller"`
+	Price    float64 `json:"price"`
+	Quantity int     `json:"quantity"`
+}
+
+// Market is the auction or double auction of a period and group, run by
+// the router so that trades don't depend on the order in which each
+// browser sees the messages.
+type Market struct {
+	Kind    string   `json:"kind"`
+	Period  int      `json:"period"`
+	Group   int      `json:"group"`
+	Reserve *float64 `json:"reserve,omitempty"`
+	Bids    []*Order `json:"bids"` // best first
+	Asks    []*Order `json:"asks"` // best first
+	Closed  bool     `json:"closed"`
+	Next    int      `json:"next"` // id of the next order
+}
+
+func (m *Market) auction() bool {
+	return m.Kind != MarketDouble
+}
+
+// add puts order on the book behind the orders with the same price.
+func (m *Market) add(order *Order, buy bool) {
+	m.Next++
+	order.ID = m.Next
+	side := &m.Asks
+	better := func(a, b float64) bool { return a < b }
+	if buy {
+		side = &m.Bids
+		better = func(a, b float64) bool { return a > b }
+	}
+	i := 0
+	for i < len(*side) && !better(order.Price, (*side)[i].Price) {
+		i++
+	}
+	*side = append(*side, nil)
+	copy((*side)[i+1:], (*side)[i:])
+	(*side)[i] = order
+}
+
+// match trades order against the other side of the book as far as their
+// prices cross, leaving the rest of order to be added to the book. Orders
+// of the same subject are passed over, nobody trades with themselves.
+func (m *Market) match(order *Order, buy bool) []*Trade {
+	var trades []*Trade
+	side := &m.Bids
+	crosses := func(resting float64) bool { return resting >= order.Price }
+	if buy {
+		side = &m.Asks
+		crosses = func(resting float64) bool { return resting <= order.Price }
+	}
+	for i := 0; order.Quantity > 0 && i < len(*side) && crosses((*side)[i].Price); {
+		resting := (*side)[i]
+		if resting.Subject == order.Subject {
+			i++
+			continue
+		}
+		trade := &Trade{Buyer: resting.Subject, Seller: order.Subject, Price: resting.Price, Quantity: resting.Quantity}
+		if buy {
+			trade.Buyer, trade.Seller = order.Subject, resting.Subject
+		}
+		if order.Quantity < trade.Quantity {
+			trade.Quantity = order.Quantity
+		}
+		order.Quantity -= trade.Quantity
+		resting.Quantity -= trade.Quantity
+		if resting.Quantity == 0 {
+			*side = append((*side)[:i], (*side)[i+1:]...)
+		}
+		trades = append(trades, trade)
+	}
+	return trades
+}
+
+// cancel removes the order with id, if it belongs to subject.
+func (m *Market) cancel(id int, subject string) {
+	for _, side := range []*[]*Order{&m.Bids, &m.Asks} {
+		for i, order := range *side {
+			if order.ID == id && order.Subject == subject {
+				*side = append((*side)[:i], (*side)[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// bid replaces the auction bid of the subject of order.
+func (m *Market) bid(order *Order) {
+	for i, earlier := range m.Bids {
+		if earlier.Subject == order.Subject {
+			m.Bids = append(m.Bids[:i], m.Bids[i+1:]...)
+			break
+		}
+	}
+	m.add(order, true)
+}
+
+// close ends an auction, returning its trade unless nothing was sold.
+func (m *Market) close() *Trade {
+	m.Closed = true
+	var bids []*Order
+	for _, bid := range m.Bids {
+		if m.Reserve == nil || bid.Price >= *m.Reserve {
+			bids = append(bids, bid)
+		}
+	}
+	if len(bids) == 0 {
+		return nil
+	}
+	trade := &Trade{Buyer: bids[0].Subject, Price: bids[0].Price, Quantity: 1}
+	if m.Kind == MarketSecondPrice {
+		switch {
+		case len(bids) > 1:
+			trade.Price = bids[1].Price
+		case m.Reserve != nil:
+			trade.Price = *m.Reserve
+		default:
+			trade.Price = 0
+		}
+	}
+	return trade
+}
+
+// book is the Value of __book__, a copy of the market at the time. Auctions
+// only tell how many have bid.
+func (m *Market) book() map[string]interface{} {
+	book := map[string]interface{}{"kind": m.Kind, "closed": m.Closed}
+	if m.auction() {
+		book["bids"] = len(m.Bids)
+		return book
+	}
+	for name, side := range map[string][]*Order{"bids": m.Bids, "asks": m.Asks} {
+		orders := make([]Order, len(side))
+		for i, order := range side {
+			orders[i] = *order
+		}
+		book[name] = orders
+	}
+	return book
+}
+
+// market returns the market of period and group, opening it as the config
+// row of the period says:
+//
+//	market   first_price or second_price for a sealed-bid auction,
+//	         double_auction for a continuous double auction
+//	reserve  lowest price an auction sells at, optional
+func (s *Session) market(period, group int) (*Market, error) {
+	key := timerKey("", period, group)
+	s.lock.RLock()
+	market, exists := s.markets[key]
+	s.lock.RUnlock()
+	if exists {
+		return market, nil
+	}
+
+	row := configRow(s.configRows(), period)
+	market = &Market{Kind: row["market"], Period: period, Group: group, Bids: []*Order{}, Asks: []*Order{}}
+	switch market.Kind {
+	case MarketFirstPrice, MarketSecondPrice, MarketDouble:
+	case "":
+		return nil, fmt.Errorf("no market in period %d", period)
+	default:
+		return nil, fmt.Errorf("unknown market %q", market.Kind)
+	}
+	if column := row["reserve"]; column != "" {
+		reserve, err := strconv.ParseFloat(column, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserve %q", column)
+		}
+		market.Reserve = &reserve
+	}
+	s.lock.Lock()
+	s.markets[key] = market
+	s.lock.Unlock()
+	return market, nil
+}
+
+// checkOrder rejects a market message before it is saved, and seals bids.
+func (s *Session) checkOrder(msg *Msg, payload Payload) error {
+	var period, group int
+	if p, ok := payload.(*CloseMarketPayload); ok {
+		period, group = *p.Period, p.Group
+	} else {
+		subject, err := s.knownSubject(msg.Sender)
+		if err != nil {
+			return err
+		}
+		if s.isPaused(subject) {
+			return errors.New("the market is paused")
+		}
+		period, group = subject.period, subject.group
+		msg.Period, msg.Group = period, group
+	}
+	market, err := s.market(period, group)
+	if err != nil {
+		return err
+	}
+	switch p := payload.(type) {
+	case *BidPayload:
+		if !market.auction() {
+			return errors.New("bids are for auctions, send an __order__")
+		}
+		if market.Closed {
+			return errors.New("the auction is closed")
+		}
+		msg.Sealed = SealAdmin
+	case *OrderPayload:
+		if market.auction() {
+			return errors.New("orders are for double auctions, send a __bid__")
+		}
+	case *CancelPayload:
+		for _, side := range [][]*Order{market.Bids, market.Asks} {
+			for _, order := range side {
+				if order.ID == *p.ID && order.Subject == msg.Sender {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no order %d of yours on the book", *p.ID)
+	}
+	return nil
+}
+
+// trade applies a market message, which has been saved already, and sends
+// the trades and the book that result.
+func (s *Session) trade(msg *Msg, payload Payload) error {
+	var market *Market
+	var err error
+	if p, ok := payload.(*CloseMarketPayload); ok {
+		market, err = s.market(*p.Period, p.Group)
+	} else {
+		market, err = s.market(msg.Period, msg.Group)
+	}
+	if err != nil {
+		return err
+	}
+
+	var trades []*Trade
+	switch p := payload.(type) {
+	case *BidPayload:
+		market.bid(&Order{Subject: msg.Sender, Price: *p.Price, Quantity: 1, Time: msg.Time})
+		members := s.members(market.Period, market.Group)
+		bidders := make(map[string]bool)
+		for _, bid := range market.Bids {
+			bidders[bid.Subject] = true
+		}
+		complete := len(members) > 0
+		for _, name := range members {
+			complete = complete && bidders[name]
+		}
+		if complete {
+			if trade := market.close(); trade != nil {
+				trades = append(trades, trade)
+			}
+		}
+	case *OrderPayload:
+		order := &Order{Subject: msg.Sender, Price: *p.Price, Quantity: p.Quantity, Time: msg.Time}
+		buy := p.Side == "buy"
+		trades = market.match(order, buy)
+		if order.Quantity > 0 {
+			market.add(order, buy)
+		}
+	case *CancelPayload:
+		market.cancel(*p.ID, msg.Sender)
+	case *CloseMarketPayload:
+		if market.auction() {
+			if market.Closed {
+				return nil
+			}
+			if trade := market.close(); trade != nil {
+				trades = append(trades, trade)
+			}
+		} else {
+			market.Bids, market.Asks = []*Order{}, []*Order{}
+		}
+	}
+
+	if err := s.saveMarkets(); err != nil {
+		return err
+	}
+	for _, trade := range trades {
+		if err := s.sendMarket(market, "__trade__", trade); err != nil {
+			return err
+		}
+	}
+	return s.sendMarket(market, "__book__", market.book())
+}
+
+func (s *Session) sendMarket(market *Market, key string, value interface{}) error {
+	return s.Receive(&Msg{
+		Instance: s.instance,
+		Session:  s.id,
+		Nonce:    s.nonce,
+		Sender:   "server",
+		Period:   market.Period,
+		Group:    market.Group,
+		Time:     time.Now().UnixNano(),
+		Key:      key,
+		Value:    value,
+	})
+}
+
+func (s *Session) saveMarkets() error {
+	s.lock.RLock()
+	data, err := json.Marshal(s.markets)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	objectID := SessionObjectID{objectType: "markets", sessionID: SessionID{s.instance, s.id}}
+	return s.router.db.SetSessionObject(objectID, data)
+}
+
+func (s *Session) loadMarkets(data []byte) error {
+	markets := make(map[string]*Market)
+	if err := json.Unmarshal(data, &markets); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.markets = markets
+	s.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDoubleAuction(t *testing.T) {
+	m := &Market{Kind: MarketDouble}
+	order := func(subject string, buy bool, price float64, quantity int) []Trade {
+		o := &Order{Subject: subject, Price: price, Quantity: quantity}
+		var trades []Trade
+		for _, trade := range m.match(o, buy) {
+			trades = append(trades, *trade)
+		}
+		if o.Quantity > 0 {
+			m.add(o, buy)
+		}
+		return trades
+	}
+	order("1", false, 10, 1)
+	order("2", false, 9, 2)
+	order("3", false, 9, 1)
+	order("4", true, 5, 1)
+	if trades := order("5", true, 9.5, 4); fmt.Sprint(trades) != "[{5 2 9 2} {5 3 9 1}]" {
+		t.Fatalf("unexpected trades %v", trades)
+	}
+	// the rest of the order rests behind the better bid
+	if len(m.Bids) != 2 || m.Bids[0].Subject != "5" || m.Bids[0].Quantity != 1 || m.Bids[1].Subject != "4" {
+		t.Fatalf("unexpected bids %+v", m.Bids)
+	}
+	if trades := order("6", false, 4, 3); fmt.Sprint(trades) != "[{5 6 9.5 1} {4 6 5 1}]" {
+		t.Fatalf("unexpected trades %v", trades)
+	}
+	if len(m.Bids) != 0 || len(m.Asks) != 2 || m.Asks[0].Subject != "6" {
+		t.Fatalf("unexpected book %+v %+v", m.Bids, m.Asks)
+	}
+
+	// subject 6 passes over its own ask for the next one
+	if trades := order("6", true, 10, 1); fmt.Sprint(trades) != "[{6 1 10 1}]" {
+		t.Fatalf("unexpected trades %v", trades)
+	}
+	if trades := order("6", true, 5, 1); len(trades) != 0 {
+		t.Fatalf("subject traded with itself: %v", trades)
+	}
+	if len(m.Bids) != 1 || len(m.Asks) != 1 || m.Asks[0].Subject != "6" || m.Asks[0].Quantity != 1 {
+		t.Fatalf("unexpected book %+v %+v", m.Bids, m.Asks)
+	}
+}
+
+func TestAuctionClose(t *testing.T) {
+	reserve := 4.0
+	for _, c := range []struct {
+		kind    string
+		reserve *float64
+		bids    []float64
+		trade   string
+	}{
+		{MarketFirstPrice, nil, []float64{3, 7, 5, 7}, "&{2  7 1}"},
+		{MarketSecondPrice, nil, []float64{3, 7, 5}, "&{2  5 1}"},
+		{MarketSecondPrice, nil, []float64{3}, "&{1  0 1}"},
+		{MarketSecondPrice, &reserve, []float64{3, 6}, "&{2  4 1}"},
+		{MarketFirstPrice, &reserve, []float64{3}, "<nil>"},
+	} {
+		m := &Market{Kind: c.kind, Reserve: c.reserve}
+		for i, price := range c.bids {
+			m.bid(&Order{Subject: fmt.Sprint(i + 1), Price: price, Quantity: 1})
+		}
+		if trade := fmt.Sprint(m.close()); trade != c.trade {
+			t.Errorf("%s of %v sold %s, expected %s", c.kind, c.bids, trade, c.trade)
+		}
+	}
+}
+
+func TestSessionMarkets(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	session := router.Session("redwood", 1)
+	nonce := session.Nonce()
+	send := func(sender, key string, value interface{}) {
+		router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: sender, Key: key, Value: value})
+	}
+	market := func(key string) []string {
+		msgs, err := db.Messages(SessionID{"redwood", 1}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values []string
+		for msg := range msgs {
+			if msg.Key == key {
+				values = append(values, fmt.Sprintf("%d/%d %v", msg.Period, msg.Group, msg.Value))
+			}
+		}
+		return values
+	}
+	send("admin", "__set_config__", "period,market,reserve\n1,second_price,2\n2,double_auction,")
+	for _, name := range []string{"1", "2"} {
+		router.RequestSubject("redwood", 1, name)
+		send(name, "__set_group__", map[string]int{"group": 1})
+		send(name, "__set_period__", map[string]int{"period": 1})
+	}
+
+	send("1", "__bid__", map[string]float64{"price": 5})
+	send("1", "__order__", map[string]interface{}{"side": "buy", "price": 5})
+	router.SessionStatus("redwood", 1)
+	if trades := market("__trade__"); len(trades) != 0 {
+		t.Fatalf("auction closed early: %v", trades)
+	}
+	if books := market("__book__"); fmt.Sprint(books) != "[1/1 map[bids:1 closed:false kind:second_price]]" {
+		t.Fatalf("unexpected books %v", books)
+	}
+	send("2", "__bid__", map[string]float64{"price": 8})
+	send("1", "__bid__", map[string]float64{"price": 9})
+	router.SessionStatus("redwood", 1)
+	if trades := market("__trade__"); fmt.Sprint(trades) != "[1/1 map[buyer:2 price:5 quantity:1 seller:]]" {
+		t.Fatalf("unexpected trades %v", trades)
+	}
+	for _, bid := range market("__bid__") {
+		if bid != "1/1 map[price:5]" && bid != "1/1 map[price:8]" {
+			t.Errorf("unexpected bid %s", bid)
+		}
+	}
+	if len(session.sealed) != 2 {
+		t.Fatalf("expected both bids to be sealed, got %v", session.sealed)
+	}
+
+	for _, name := range []string{"1", "2"} {
+		send(name, "__set_period__", map[string]int{"period": 2})
+	}
+	send("1", "__order__", map[string]interface{}{"side": "sell", "price": 3, "quantity": 2})
+	send("2", "__cancel__", map[string]int{"id": 1})
+	send("2", "__order__", map[string]interface{}{"side": "buy", "price": 4})
+	router.SessionStatus("redwood", 1)
+	if trades := market("__trade__"); len(trades) != 2 || trades[1] != "2/1 map[buyer:2 price:3 quantity:1 seller:1]" {
+		t.Fatalf("unexpected trades %v", trades)
+	}
+	if orders := market("__order__"); len(orders) != 2 {
+		t.Fatalf("orders outside the double auction were saved: %v", orders)
+	}
+
+	// the book survives a restart
+	restarted := NewRouter(db, Options{}).Session("redwood", 1)
+	if m := restarted.markets[timerKey("", 2, 1)]; m == nil || len(m.Asks) != 1 || m.Asks[0].Quantity != 1 {
+		t.Fatalf("unexpected market after restart %+v", m)
+	}
+}
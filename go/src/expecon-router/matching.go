@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// draws tried by the stranger scheme to avoid regrouping subjects
+const strangerDraws = 100
+
+// Matching records the groups the router has drawn. It is persisted as the
+// "matching" session object.
+type Matching struct {
+	Periods  map[int]map[string]int `json:"periods"`  // group of each subject per period
+	Partners map[string]int         `json:"partners"` // groups shared by all partner periods
+}
+
+func NewMatching() *Matching {
+	return &Matching{
+		Periods:  make(map[int]map[string]int),
+		Partners: make(map[string]int),
+	}
+}
+
+// configRow returns the config row of period, found the same way the
+// subject pages do: by its "period" column, or by position if it has none.
+func configRow(rows []map[string]string, period int) map[string]string {
+	for i, row := range rows {
+		if p, err := strconv.Atoi(row["period"]); err == nil {
+			if p == period {
+				return row
+			}
+		} else if i+1 == period {
+			return row
+		}
+	}
+	return nil
+}
+
+// sortSubjects orders subject names numerically if they are all numbers.
+func sortSubjects(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.Atoi(names[i])
+		b, errB := strconv.Atoi(names[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+}
+
+// chunkGroups puts names into consecutive groups of size, numbered from 1.
+func chunkGroups(names []string, size int) map[string]int {
+	groups := make(map[string]int, len(names))
+	for i, name := range names {
+		if size <= 0 {
+			groups[name] = 1
+		} else {
+			groups[name] = i/size + 1
+		}
+	}
+	return groups
+}
+
+// parseGroups reads the "groups" config column.
+func parseGroups(column string) (map[string]int, error) {
+	decoder := json.NewDecoder(strings.NewReader(column))
+	decoder.UseNumber()
+	var lists [][]interface{}
+	if err := decoder.Decode(&lists); err != nil {
+		return nil, fmt.Errorf("groups column is not an array of arrays: %v", err)
+	}
+	groups := make(map[string]int)
+	for i, list := range lists {
+		for _, name := range list {
+			groups[fmt.Sprint(name)] = i + 1
+		}
+	}
+	return groups, nil
+}
+
+// repeatedPairs counts the pairs grouped together by groups that have
+// already been grouped together in one of the earlier matchings.
+func repeatedPairs(groups map[string]int, earlier []map[string]int) int {
+	members := make(map[int][]string)
+	for name, group := range groups {
+		members[group] = append(members[group], name)
+	}
+	count := 0
+	for _, names := range members {
+		for i := range names {
+			for j := i + 1; j < len(names); j++ {
+				for _, previous := range earlier {
+					a, okA := previous[names[i]]
+					b, okB := previous[names[j]]
+					if okA && okB && a == b {
+						count++
+						break
+					}
+				}
+			}
+		}
+	}
+	return count
+}
+
+// strangerGroups draws random groups, keeping the draw that regroups the
+// fewest pairs of subjects that have met in earlier matchings.
+func strangerGroups(names []string, size int, earlier []map[string]int, rnd *rand.Rand) map[string]int {
+	var best map[string]int
+	bestRepeats := -1
+	shuffled := append([]string(nil), names...)
+	for i := 0; i < strangerDraws && bestRepeats != 0; i++ {
+		rnd.Shuffle(len(shuffled), func(a, b int) { shuffled[a], shuffled[b] = shuffled[b], shuffled[a] })
+		groups := chunkGroups(shuffled, size)
+		if repeats := repeatedPairs(groups, earlier); bestRepeats < 0 || repeats < bestRepeats {
+			best, bestRepeats = groups, repeats
+		}
+	}
+	return best
+}
+
+// drawGroups assigns names to groups by the matching scheme of row:
+//
+//	matching    fixed, partner, random or stranger
+//	group_size  subjects per group, everyone shares group 1 if missing
+//	groups      fixed only, a JSON array of arrays of subject names
+func drawGroups(row map[string]string, names []string, matching *Matching, rnd *rand.Rand) (map[string]int, error) {
+	size := 0
+	if column := row["group_size"]; column != "" {
+		var err error
+		if size, err = strconv.Atoi(column); err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid group_size %q", column)
+		}
+	}
+
+	switch row["matching"] {
+	case "fixed":
+		if column := row["groups"]; column != "" {
+			return parseGroups(column)
+		}
+		return chunkGroups(names, size), nil
+	case "partner":
+		if len(matching.Partners) == 0 {
+			matching.Partners = strangerGroups(names, size, nil, rnd)
+		}
+		groups := make(map[string]int, len(matching.Partners))
+		for name, group := range matching.Partners {
+			groups[name] = group
+		}
+		return groups, nil
+	case "random":
+		return strangerGroups(names, size, nil, rnd), nil
+	case "stranger":
+		earlier := make([]map[string]int, 0, len(matching.Periods))
+		for _, groups := range matching.Periods {
+			earlier = append(earlier, groups)
+		}
+		return strangerGroups(names, size, earlier, rnd), nil
+	}
+	return nil, fmt.Errorf("unknown matching scheme %q", row["matching"])
+}
+
+// joinGroup adds a subject that was not around when groups were drawn to
+// the first group with room left, or to a new group.
+func joinGroup(groups map[string]int, name string, size int) int {
+	counts := make(map[int]int)
+	last := 0
+	for _, group := range groups {
+		counts[group]++
+		if group > last {
+			last = group
+		}
+	}
+	group := last + 1
+	for g := 1; g <= last; g++ {
+		if size <= 0 || counts[g] < size {
+			group = g
+			break
+		}
+	}
+	groups[name] = group
+	return group
+}
+
+// configRows returns the rows of the last config, which is only decoded
+// again after the router restarted.
+func (s *Session) configRows() []map[string]string {
+	if s.config == nil && s.last_cfg != nil {
+		if payload, err := DecodePayload(s.last_cfg); err == nil {
+			s.config = payload.(*SetConfigPayload).Rows
+		}
+	}
+	return s.config
+}
+
+// matched reports whether the config has the router match any period.
+func (s *Session) matched() bool {
+	for _, row := range s.configRows() {
+		if row["matching"] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// participants lists the subjects of the session in order, leaving out the
+// admin and observer connections.
+func (s *Session) participants() []string {
+	names := make([]string, 0, len(s.subjects))
+	for name := range s.subjects {
+		if name != "" && RoleFor(name) == RoleSubject {
+			names = append(names, name)
+		}
+	}
+	sortSubjects(names)
+	return names
+}
+
+// groupFor returns the group subject is matched into in period, drawing the
+// groups of the period first if needed. ok is false if the config leaves
+// the group of the period to the subject pages.
+func (s *Session) groupFor(subject *Subject, period int) (group int, ok bool, err error) {
+	row := configRow(s.configRows(), period)
+	if row == nil || row["matching"] == "" {
+		return 0, false, nil
+	}
+
+	groups, drawn := s.matching.Periods[period]
+	if !drawn {
+		if groups, err = drawGroups(row, s.participants(), s.matching, s.rand); err != nil {
+			return 0, false, err
+		}
+		s.matching.Periods[period] = groups
+	}
+	group, exists := groups[subject.name]
+	if !exists {
+		size, _ := strconv.Atoi(row["group_size"])
+		group = joinGroup(groups, subject.name, size)
+		if row["matching"] == "partner" {
+			s.matching.Partners[subject.name] = group
+		}
+	}
+	if !drawn || !exists {
+		if err = s.saveMatching(); err != nil {
+			return 0, false, err
+		}
+	}
+	return group, true, nil
+}
+
+func (s *Session) saveMatching() error {
+	data, err := json.Marshal(s.matching)
+	if err != nil {
+		return err
+	}
+	objectID := SessionObjectID{objectType: "matching", sessionID: SessionID{s.instance, s.id}}
+	return s.router.db.SetSessionObject(objectID, data)
+}
+
+// assignGroup moves subject into its group of period before it enters the
+// period, pushing a __set_group__ to it if the group changes.
+func (s *Session) assignGroup(subject *Subject, period int) (assigned bool, err error) {
+	group, ok, err := s.groupFor(subject, period)
+	if !ok || err != nil || group == subject.group {
+		return ok, err
+	}
+	s.HandleMessage(&Msg{
+		Instance:    s.instance,
+		Session:     s.id,
+		Nonce:       s.nonce,
+		Sender:      subject.name,
+		Period:      period,
+		Group:       group,
+		StateUpdate: true,
+		Key:         "__set_group__",
+		Value:       map[string]int{"group": group},
+	})
+	if subject.group != group {
+		return true, fmt.Errorf("could not move %s to group %d", subject.name, group)
+	}
+	return true, nil
+}
+
+// assign moves the named subjects, or all of them, to period. All names are
+// checked before anyone is moved. The periods the subjects leave end first,
+// then everyone is moved into their new group, and only then into period,
+// so no message is routed by a half done reassignment.
+func (s *Session) assign(period int, names []string) error {
+	if len(names) == 0 {
+		names = s.participants()
+	}
+	subjects := make([]*Subject, len(names))
+	for i, name := range names {
+		subject, err := s.knownSubject(name)
+		if err != nil {
+			return err
+		}
+		subjects[i] = subject
+	}
+	for _, subject := range subjects {
+		if subject.period != period {
+			if err := s.revealPeriod(subject); err != nil {
+				return err
+			}
+		}
+	}
+	for _, subject := range subjects {
+		if _, err := s.assignGroup(subject, period); err != nil {
+			return err
+		}
+	}
+	s.assigning = true
+	defer func() { s.assigning = false }()
+	for _, name := range names {
+		s.HandleMessage(&Msg{
+			Instance:    s.instance,
+			Session:     s.id,
+			Nonce:       s.nonce,
+			Sender:      name,
+			Period:      period,
+			StateUpdate: true,
+			Key:         "__set_period__",
+			Value:       map[string]int{"period": period},
+		})
+	}
+	return nil
+}
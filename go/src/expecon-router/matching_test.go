@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestConfigRow(t *testing.T) {
+	positional := []map[string]string{{"x": "a"}, {"x": "b"}}
+	if row := configRow(positional, 2); row["x"] != "b" {
+		t.Errorf("expected the second row, got %v", row)
+	}
+	numbered := []map[string]string{{"period": "2", "x": "a"}, {"period": "1", "x": "b"}}
+	if row := configRow(numbered, 1); row["x"] != "b" {
+		t.Errorf("expected the row of period 1, got %v", row)
+	}
+	if row := configRow(numbered, 3); row != nil {
+		t.Errorf("expected no row, got %v", row)
+	}
+}
+
+func TestDrawGroups(t *testing.T) {
+	names := []string{"10", "2", "1", "3"}
+	sortSubjects(names)
+	if fmt.Sprint(names) != "[1 2 3 10]" {
+		t.Fatalf("unexpected order %v", names)
+	}
+	rnd := rand.New(rand.NewSource(1))
+
+	matching := NewMatching()
+	groups, err := drawGroups(map[string]string{"matching": "fixed", "group_size": "2"}, names, matching, rnd)
+	if err != nil || fmt.Sprint(groups) != "map[1:1 10:2 2:1 3:2]" {
+		t.Fatalf("unexpected fixed groups %v (%v)", groups, err)
+	}
+	groups, err = drawGroups(map[string]string{"matching": "fixed", "groups": "[[1,3],[\"2\",10]]"}, names, matching, rnd)
+	if err != nil || fmt.Sprint(groups) != "map[1:1 10:2 2:2 3:1]" {
+		t.Fatalf("unexpected explicit groups %v (%v)", groups, err)
+	}
+
+	partners, err := drawGroups(map[string]string{"matching": "partner", "group_size": "2"}, names, matching, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := drawGroups(map[string]string{"matching": "partner", "group_size": "2"}, names, matching, rnd)
+	if fmt.Sprint(partners) != fmt.Sprint(again) {
+		t.Fatalf("partners changed from %v to %v", partners, again)
+	}
+
+	matching.Periods[1] = partners
+	strangers, err := drawGroups(map[string]string{"matching": "stranger", "group_size": "2"}, names, matching, rnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repeats := repeatedPairs(strangers, []map[string]int{partners}); repeats != 0 {
+		t.Fatalf("strangers %v regroup %d pairs of %v", strangers, repeats, partners)
+	}
+
+	if _, err := drawGroups(map[string]string{"matching": "bogus"}, names, matching, rnd); err == nil {
+		t.Fatal("unknown scheme accepted")
+	}
+}
+
+func TestJoinGroup(t *testing.T) {
+	groups := map[string]int{"1": 1, "2": 1, "3": 2}
+	if group := joinGroup(groups, "4", 2); group != 2 {
+		t.Fatalf("expected group 2, got %d", group)
+	}
+	if group := joinGroup(groups, "5", 2); group != 3 {
+		t.Fatalf("expected group 3, got %d", group)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	session := router.Session("redwood", 1)
+	subjects := make([]*Subject, 4)
+	for i := range subjects {
+		subjects[i] = router.RequestSubject("redwood", 1, fmt.Sprint(i+1))
+	}
+	nonce := session.Nonce()
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "admin", Key: "__set_config__",
+		Value: "period,matching,group_size\n1,fixed,2\n2,stranger,2"})
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "admin", Key: "__assign__",
+		Value: map[string]interface{}{"period": 1}})
+	// a status request waits for both to be handled
+	router.SessionStatus("redwood", 1)
+	for i, subject := range subjects {
+		if subject.period != 1 || subject.group != i/2+1 {
+			t.Fatalf("subject %s in period %d group %d", subject.name, subject.period, subject.group)
+		}
+	}
+
+	// subjects can't regroup themselves
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Key: "__set_group__",
+		Value: map[string]interface{}{"group": 2}})
+	router.SessionStatus("redwood", 1)
+	if subjects[0].group != 1 {
+		t.Fatalf("subject 1 moved itself to group %d", subjects[0].group)
+	}
+
+	// a subject moving on by itself is matched with a stranger
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Key: "__set_period__",
+		Value: map[string]interface{}{"period": 2}})
+	router.SessionStatus("redwood", 1)
+	partner := ""
+	for name, group := range session.matching.Periods[2] {
+		if name != "1" && group == session.matching.Periods[2]["1"] {
+			partner = name
+		}
+	}
+	if partner == "2" || subjects[0].group != session.matching.Periods[2]["1"] {
+		t.Fatalf("unexpected matching %v, subject 1 in group %d", session.matching.Periods, subjects[0].group)
+	}
+
+	// the matching survives a restart
+	restarted := NewRouter(db, Options{}).Session("redwood", 1)
+	if fmt.Sprint(restarted.matching.Periods) != fmt.Sprint(session.matching.Periods) {
+		t.Fatalf("matching %v reloaded as %v", session.matching.Periods, restarted.matching.Periods)
+	}
+}
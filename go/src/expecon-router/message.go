@@ -1,7 +1,22 @@
 package main
 
-// Messages are namespaced by a session identifier. Group is set by the Redwood
-// server. Only receivers in the same group as sender will receive the message.
+// Messages are namespaced by a session identifier. Period and Group are set by
+// the Redwood server from the sender's state, whatever the client sent. Only
+// receivers in the same group as sender will receive the message.
+//
+// Sender is the subject the message is from. Admin connections may send on
+// behalf of a subject, Origin then names who actually sent it.
+//
+// Recipients, if set, restricts delivery of the message, live and on
+// replay, to the named subjects, its sender and the admin.
+//
+// Sealed, if set, hides the message from everyone but its sender and the
+// admin until the router reveals it, see sealed.go. Submitted is the Time of
+// the sealed message a reveal copies.
+//
+// Override, which only admin connections may set, keeps the Period and Group
+// sent by the client so the experimenter can target a specific period or
+// group, or every period with Period 0. It stays in the queue as a record of the override.
 //
 // Time, also set by the server, provides a unique message ordering.
 //
@@ -11,13 +26,31 @@ type Msg struct {
 	Session     int
 	Nonce       string
 	Sender      string
+	Origin      string `json:",omitempty"`
 	Period      int
 	Group       int
 	StateUpdate bool
+	Override    bool `json:",omitempty"`
 	Time        int64
 	ClientTime  uint64
 	Key         string
 	Value       interface{}
+	Recipients  []string `json:",omitempty"`
+	Sealed      string   `json:",omitempty"`
+	Submitted   int64    `json:",omitempty"`
+}
+
+// AddressedTo reports whether the named subject may receive msg.
+func (msg *Msg) AddressedTo(name string) bool {
+	if len(msg.Recipients) == 0 || msg.Sender == name {
+		return true
+	}
+	for _, recipient := range msg.Recipients {
+		if recipient == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (msg *Msg) IdenticalTo(otherMsg *Msg) bool {
@@ -28,9 +61,11 @@ func (msg *Msg) IdenticalTo(otherMsg *Msg) bool {
 		msg.Session == otherMsg.Session &&
 		msg.Nonce == otherMsg.Nonce &&
 		msg.Sender == otherMsg.Sender &&
+		msg.Origin == otherMsg.Origin &&
 		msg.Period == otherMsg.Period &&
 		msg.Group == otherMsg.Group &&
 		msg.StateUpdate == otherMsg.StateUpdate &&
+		msg.Override == otherMsg.Override &&
 		msg.Time == otherMsg.Time &&
 		msg.ClientTime == otherMsg.ClientTime &&
 		msg.Key == otherMsg.Key
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	syncBuckets  = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+	redisBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+)
+
+// histogram counts observations into cumulative buckets, as Prometheus
+// expects them.
+type histogram struct {
+	bounds []float64
+	counts []int64 // one per bound, plus +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(bound), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, cumulative)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, cumulative)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelEscaper escapes a label value as the text format wants it, which
+// unlike Go quoting leaves every other character as it is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label quotes a label value.
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func sessionLabels(sessionID SessionID) string {
+	return label("instance", sessionID.instance) + "," + label("session", strconv.Itoa(sessionID.id))
+}
+
+// Metrics collects the counters that can't be read off the router when it
+// is scraped. It is safe for concurrent use.
+type Metrics struct {
+	lock         sync.Mutex
+	connected    map[SessionID]int
+	messages     map[string]int64 // handled by key
+	syncs        *histogram
+	syncMessages int64
+	redis        map[string]*histogram // latency by command
+	redisErrors  map[string]int64      // by command
+	disconnects  map[string]int64      // by reason
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		connected:   make(map[SessionID]int),
+		messages:    make(map[string]int64),
+		syncs:       newHistogram(syncBuckets),
+		redis:       make(map[string]*histogram),
+		redisErrors: make(map[string]int64),
+		disconnects: make(map[string]int64),
+	}
+}
+
+func (m *Metrics) Connected(sessionID SessionID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.connected[sessionID]++
+}
+
+// Disconnected records the end of a connection. reason is "client" if the
+// client went away, "timeout" if it missed its heartbeats, "overflow" if
+// its send queue overflowed and "shutdown" if the router is shutting down.
+func (m *Metrics) Disconnected(sessionID SessionID, reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.connected[sessionID]--; m.connected[sessionID] <= 0 {
+		delete(m.connected, sessionID)
+	}
+	m.disconnects[reason]++
+}
+
+func (m *Metrics) Handled(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages[key]++
+}
+
+// Synced records a Sync that sent count messages.
+func (m *Metrics) Synced(elapsed time.Duration, count int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.syncs.observe(elapsed.Seconds())
+	m.syncMessages += int64(count)
+}
+
+// ObserveRedis is hooked into the Redis client, see RedisDatabase.SetObserver.
+func (m *Metrics) ObserveRedis(cmd string, elapsed time.Duration, err error) {
+	cmd = strings.ToUpper(cmd)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, exists := m.redis[cmd]
+	if !exists {
+		h = newHistogram(redisBuckets)
+		m.redis[cmd] = h
+	}
+	h.observe(elapsed.Seconds())
+	if err != nil {
+		m.redisErrors[cmd]++
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintln(w, "# HELP expecon_listeners Connected websockets per session.")
+	fmt.Fprintln(w, "# TYPE expecon_listeners gauge")
+	sessionIDs := make([]SessionID, 0, len(m.connected))
+	for sessionID := range m.connected {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	sort.Slice(sessionIDs, func(i, j int) bool {
+		if sessionIDs[i].instance != sessionIDs[j].instance {
+			return sessionIDs[i].instance < sessionIDs[j].instance
+		}
+		return sessionIDs[i].id < sessionIDs[j].id
+	})
+	for _, sessionID := range sessionIDs {
+		fmt.Fprintf(w, "expecon_listeners{%s} %d\n", sessionLabels(sessionID), m.connected[sessionID])
+	}
+
+	fmt.Fprintln(w, "# HELP expecon_messages_total Messages handled by session loops, by key.")
+	fmt.Fprintln(w, "# TYPE expecon_messages_total counter")
+	for _, key := range sortedKeys(m.messages) {
+		fmt.Fprintf(w, "expecon_messages_total{%s} %d\n", label("key", key), m.messages[key])
+	}
+
+	fmt.Fprintln(w, "# HELP expecon_sync_duration_seconds Time taken to sync a new connection.")
+	fmt.Fprintln(w, "# TYPE expecon_sync_duration_seconds histogram")
+	m.syncs.write(w, "expecon_sync_duration_seconds", "")
+	fmt.Fprintln(w, "# HELP expecon_sync_messages_total Messages replayed by syncs.")
+	fmt.Fprintln(w, "# TYPE expecon_sync_messages_total counter")
+	fmt.Fprintf(w, "expecon_sync_messages_total %d\n", m.syncMessages)
+
+	fmt.Fprintln(w, "# HELP expecon_redis_command_duration_seconds Latency of Redis commands.")
+	fmt.Fprintln(w, "# TYPE expecon_redis_command_duration_seconds histogram")
+	commands := make([]string, 0, len(m.redis))
+	for cmd := range m.redis {
+		commands = append(commands, cmd)
+	}
+	sort.Strings(commands)
+	for _, cmd := range commands {
+		m.redis[cmd].write(w, "expecon_redis_command_duration_seconds", label("command", cmd))
+	}
+	fmt.Fprintln(w, "# HELP expecon_redis_errors_total Failed Redis commands.")
+	fmt.Fprintln(w, "# TYPE expecon_redis_errors_total counter")
+	for _, cmd := range sortedKeys(m.redisErrors) {
+		fmt.Fprintf(w, "expecon_redis_errors_total{%s} %d\n", label("command", cmd), m.redisErrors[cmd])
+	}
+
+	fmt.Fprintln(w, "# HELP expecon_websocket_disconnects_total Closed websockets, by reason.")
+	fmt.Fprintln(w, "# TYPE expecon_websocket_disconnects_total counter")
+	for _, reason := range sortedKeys(m.disconnects) {
+		fmt.Fprintf(w, "expecon_websocket_disconnects_total{%s} %d\n", label("reason", reason), m.disconnects[reason])
+	}
+}
+
+// ServeMetrics writes the metrics of the router in the Prometheus text
+// format, with the loop queue depths read off the sessions at the time of
+// the request. With a secret, scrapers send it as a bearer token.
+func (r *Router) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	if err := r.authorizeAPI(req, "", 0, false); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.metrics.write(w)
+
+	sessions := r.Sessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].instance != sessions[j].instance {
+			return sessions[i].instance < sessions[j].instance
+		}
+		return sessions[i].id < sessions[j].id
+	})
+	fmt.Fprintln(w, "# HELP expecon_session_queue_depth Items waiting for a session loop, by channel.")
+	fmt.Fprintln(w, "# TYPE expecon_session_queue_depth gauge")
+	for _, session := range sessions {
+		labels := sessionLabels(SessionID{session.instance, session.id})
+		fmt.Fprintf(w, "expecon_session_queue_depth{%s,%s} %d\n", labels, label("queue", "messages"), len(session.messages))
+		fmt.Fprintf(w, "expecon_session_queue_depth{%s,%s} %d\n", labels, label("queue", "newListeners"), len(session.newListeners))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{Secret: "secret"})
+	session := router.Session("redwood", 1)
+	router.RequestSubject("redwood", 1, "1")
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: session.Nonce(), Sender: "1", Key: "choice", Value: 1})
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: session.Nonce(), Sender: "1", Key: "choice", Value: 2})
+	router.SessionStatus("redwood", 1)
+
+	sessionID := SessionID{"redwood", 1}
+	router.metrics.Connected(sessionID)
+	router.metrics.Connected(sessionID)
+	router.metrics.Disconnected(sessionID, "overflow")
+	router.metrics.Synced(20*time.Millisecond, 3)
+	router.metrics.ObserveRedis("get", 2*time.Millisecond, nil)
+	router.metrics.ObserveRedis("get", 20*time.Millisecond, errors.New("down"))
+
+	scrape := func(authorized bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if authorized {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeMetrics(recorder, req)
+		return recorder
+	}
+	if response := scrape(false); response.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without the secret, got %d", response.Code)
+	}
+	response := scrape(true)
+	if response.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", response.Code)
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(response.Body.String(), "\n") {
+		lines[line] = true
+	}
+	for _, expected := range []string{
+		`expecon_listeners{instance="redwood",session="1"} 1`,
+		`expecon_messages_total{key="choice"} 2`,
+		`expecon_sync_duration_seconds_bucket{le="0.01"} 0`,
+		`expecon_sync_duration_seconds_bucket{le="0.05"} 1`,
+		`expecon_sync_duration_seconds_count 1`,
+		`expecon_sync_messages_total 3`,
+		`expecon_redis_command_duration_seconds_bucket{command="GET",le="0.005"} 1`,
+		`expecon_redis_command_duration_seconds_bucket{command="GET",le="+Inf"} 2`,
+		`expecon_redis_errors_total{command="GET"} 1`,
+		`expecon_websocket_disconnects_total{reason="overflow"} 1`,
+		`expecon_session_queue_depth{instance="redwood",session="1",queue="messages"} 0`,
+	} {
+		if !lines[expected] {
+			t.Errorf("missing %s in\n%s", expected, response.Body)
+		}
+	}
+}
+
+func TestMetricsLabel(t *testing.T) {
+	if l := label("instance", "café \"a\\b\"\n\x00"); l != `instance="café \"a\\b\"\n`+"\x00\"" {
+		t.Fatalf("unexpected label %s", l)
+	}
+}
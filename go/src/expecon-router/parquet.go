@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Parquet enums used by the writer.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+	parquetRequired  = 0
+	parquetUTF8      = 0
+	parquetPlain     = 0
+	parquetRLE       = 3
+	parquetDataPage  = 0
+	parquetCodecNone = 0
+)
+
+// ParquetColumn holds the values of one column, either Ints or Strings.
+type ParquetColumn struct {
+	Name    string
+	Ints    []int64
+	Strings []string
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Thrift structs in the compact protocol. Fields must
+// be written in increasing order of their ids.
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastIDs []int16 // last field id of each open struct
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	last := &t.lastIDs[len(t.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(b string) {
+	t.varint(uint64(len(b)))
+	t.buf.WriteString(b)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+// list starts a list field of n elements of kind, which the caller writes
+// next.
+func (t *thriftWriter) list(id int16, kind byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | kind)
+	} else {
+		t.buf.WriteByte(0xf0 | kind)
+		t.varint(uint64(n))
+	}
+}
+
+// begin starts a struct, either as field id or, with id 0, as the top level
+// struct or a list element.
+func (t *thriftWriter) begin(id int16) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+	t.lastIDs = append(t.lastIDs, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.lastIDs = t.lastIDs[:len(t.lastIDs)-1]
+}
+
+// page encodes the values of column in PLAIN encoding.
+func (column *ParquetColumn) page() []byte {
+	var page bytes.Buffer
+	if column.Strings == nil {
+		for _, v := range column.Ints {
+			binary.Write(&page, binary.LittleEndian, v)
+		}
+		return page.Bytes()
+	}
+	for _, s := range column.Strings {
+		binary.Write(&page, binary.LittleEndian, uint32(len(s)))
+		page.WriteString(s)
+	}
+	return page.Bytes()
+}
+
+func (column *ParquetColumn) kind() int32 {
+	if column.Strings == nil {
+		return parquetInt64
+	}
+	return parquetByteArray
+}
+
+// WriteParquet writes rows values of each column as a Parquet file with a
+// single row group and one PLAIN encoded, uncompressed data page per column,
+// see https://github.com/apache/parquet-format.
+func WriteParquet(w io.Writer, columns []*ParquetColumn, rows int) error {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	// column chunks, remembering where each starts and how long it is
+	offsets := make([]int64, len(columns))
+	sizes := make([]int64, len(columns))
+	if rows > 0 {
+		for i, column := range columns {
+			data := column.page()
+			header := &thriftWriter{}
+			header.begin(0) // PageHeader
+			header.i32(1, parquetDataPage)
+			header.i32(2, int32(len(data))) // uncompressed_page_size
+			header.i32(3, int32(len(data))) // compressed_page_size
+			header.begin(5)                 // DataPageHeader
+			header.i32(1, int32(rows))      // num_values
+			header.i32(2, parquetPlain)
+			header.i32(3, parquetRLE) // definition_level_encoding
+			header.i32(4, parquetRLE) // repetition_level_encoding
+			header.end()
+			header.end()
+
+			offsets[i] = int64(file.Len())
+			sizes[i] = int64(header.buf.Len() + len(data))
+			file.Write(header.buf.Bytes())
+			file.Write(data)
+		}
+	}
+
+	meta := &thriftWriter{}
+	meta.begin(0)  // FileMetaData
+	meta.i32(1, 1) // version
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.begin(0) // root SchemaElement
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(columns))) // num_children
+	meta.end()
+	for _, column := range columns {
+		meta.begin(0)
+		meta.i32(1, column.kind())
+		meta.i32(3, parquetRequired)
+		meta.str(4, column.Name)
+		if column.Strings != nil {
+			meta.i32(6, parquetUTF8)
+		}
+		meta.end()
+	}
+	meta.i64(3, int64(rows))
+	if rows > 0 {
+		meta.list(4, thriftStruct, 1)
+		meta.begin(0) // RowGroup
+		meta.list(1, thriftStruct, len(columns))
+		var total int64
+		for i, column := range columns {
+			meta.begin(0) // ColumnChunk
+			meta.i64(2, offsets[i])
+			meta.begin(3) // ColumnMetaData
+			meta.i32(1, column.kind())
+			meta.list(2, thriftI32, 1)
+			meta.zigzag(parquetPlain)
+			meta.list(3, thriftBinary, 1)
+			meta.binary(column.Name)
+			meta.i32(4, parquetCodecNone)
+			meta.i64(5, int64(rows))
+			meta.i64(6, sizes[i]) // total_uncompressed_size
+			meta.i64(7, sizes[i]) // total_compressed_size
+			meta.i64(9, offsets[i])
+			meta.end()
+			meta.end()
+			total += sizes[i]
+		}
+		meta.i64(2, total)
+		meta.i64(3, int64(rows))
+		meta.end()
+	} else {
+		meta.list(4, thriftStruct, 0)
+	}
+	meta.str(6, "expecon-router")
+	meta.end()
+
+	file.Write(meta.buf.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(meta.buf.Len()))
+	file.WriteString("PAR1")
+	_, err := w.Write(file.Bytes())
+	return err
+}
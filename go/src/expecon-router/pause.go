@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var ErrPaused = errors.New("subject is paused")
+
+// isPaused reports whether subject is paused in its current period. Must be
+// called from the session loop.
+func (s *Session) isPaused(subject *Subject) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	period, paused := s.paused[subject.name]
+	return paused && subject.period >= period
+}
+
+// pauseKeys get through while the subject is paused.
+var pauseKeys = map[string]bool{
+	"__pause__":   true,
+	"__paused__":  true,
+	"__resume__":  true,
+	"__resumed__": true,
+}
+
+// blockedByPause reports whether msg is sent by a paused subject itself.
+// Messages the admin sends on behalf of the subject carry an Origin and
+// still get through.
+func (s *Session) blockedByPause(msg *Msg) bool {
+	subject, exists := s.subjects[msg.Sender]
+	return exists && msg.Origin == "" && !pauseKeys[msg.Key] && s.isPaused(subject)
+}
+
+// PausedSubjects maps the paused subjects to the period their pause starts
+// at. Only subject itself is included unless all is set. It is safe to call
+// from outside the session loop.
+func (s *Session) PausedSubjects(subject string, all bool) map[string]int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	paused := make(map[string]int)
+	for name, period := range s.paused {
+		if all || name == subject {
+			paused[name] = period
+		}
+	}
+	return paused
+}
+
+// handlePause applies the pause keys to the pause state of msg.Sender.
+func (s *Session) handlePause(msg *Msg, period int) error {
+	if _, err := s.knownSubject(msg.Sender); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	pausedFrom, paused := s.paused[msg.Sender]
+	switch msg.Key {
+	case "__pause__", "__paused__":
+		if !paused || period < pausedFrom {
+			s.paused[msg.Sender] = period
+		}
+	case "__resume__":
+		delete(s.paused, msg.Sender)
+	case "__resumed__":
+		// an acknowledgement, saved with the queue only
+		s.lock.Unlock()
+		return nil
+	}
+	pausedFrom, paused = s.paused[msg.Sender]
+	s.lock.Unlock()
+	delete(s.pauseReported, msg.Sender)
+
+	if !paused {
+		pausedFrom = -1
+	}
+	objectID := SessionObjectID{objectType: "paused", sessionID: SessionID{s.instance, s.id}, subject: msg.Sender}
+	return s.router.db.SetSessionObject(objectID, []byte(strconv.Itoa(pausedFrom)))
+}
+
+// rejectPaused reports a message of a paused subject as rejected, but only
+// the first one of each pause, so busy pages don't flood the admin with
+// errors.
+func (s *Session) rejectPaused(msg *Msg) {
+	if s.pauseReported[msg.Sender] {
+		return
+	}
+	s.pauseReported[msg.Sender] = true
+	s.SendError(msg.Sender, fmt.Errorf("%s: %v, its messages are dropped until it is resumed", msg.Key, ErrPaused))
+}
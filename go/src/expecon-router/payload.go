@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A Payload is the decoded Value of a reserved message. Validate is called
+// after decoding and should reject anything that would corrupt router or
+// subject state.
+type Payload interface {
+	Validate() error
+}
+
+// payloadSchemas maps each reserved key to a constructor for its payload.
+// Keys that are not listed here are passed through without validation.
+var payloadSchemas = map[string]func() Payload{
+	"__register__":   func() Payload { return new(RegisterPayload) },
+	"__reset__":      func() Payload { return new(NoPayload) },
+	"__delete__":     func() Payload { return new(NoPayload) },
+	"__set_config__": func() Payload { return new(SetConfigPayload) },
+	"__set_period__": func() Payload { return new(SetPeriodPayload) },
+	"__set_group__":  func() Payload { return new(SetGroupPayload) },
+	"__set_page__":   func() Payload { return new(SetPagePayload) },
+	"__get_period__": func() Payload { return new(PeriodPayload) },
+	"__pause__":      func() Payload { return new(PeriodPayload) },
+	"__paused__":     func() Payload { return new(PeriodPayload) },
+	"__resume__":     func() Payload { return new(PeriodPayload) },
+	"__resumed__":    func() Payload { return new(PeriodPayload) },
+	"__set_points__": func() Payload { return new(SetPointsPayload) },
+	"__mark_paid__":  func() Payload { return new(MarkPaidPayload) },
+	"__assign__":     func() Payload { return new(AssignPayload) },
+
+	"__start_timer__": func() Payload { return new(StartTimerPayload) },
+	"__stop_timer__":  func() Payload { return new(TimerPayload) },
+	"__ready__":       func() Payload { return new(BarrierPayload) },
+	"__reveal__":      func() Payload { return new(RevealPayload) },
+
+	"__bid__":          func() Payload { return new(BidPayload) },
+	"__order__":        func() Payload { return new(OrderPayload) },
+	"__cancel__":       func() Payload { return new(CancelPayload) },
+	"__close_market__": func() Payload { return new(CloseMarketPayload) },
+	"__get_ledger__":   func() Payload { return new(NoPayload) },
+
+	"__set_conversion_rate__":    func() Payload { return &AmountPayload{field: "conversion_rate"} },
+	"__set_show_up_fee__":        func() Payload { return &AmountPayload{field: "show_up_fee"} },
+	"__set_lottery_conversion__": func() Payload { return &AmountPayload{field: "lottery_conversion"} },
+	"__set_lottery_pay__":        func() Payload { return &AmountPayload{field: "lottery_pay", period: true} },
+
+	// only ever generated by the router itself
+	"__error__":         func() Payload { return new(ServerOnlyPayload) },
+	"__queue_start__":   func() Payload { return new(ServerOnlyPayload) },
+	"__queue_end__":     func() Payload { return new(ServerOnlyPayload) },
+	"__timer_tick__":    func() Payload { return new(ServerOnlyPayload) },
+	"__timer_expired__": func() Payload { return new(ServerOnlyPayload) },
+	"__release__":       func() Payload { return new(ServerOnlyPayload) },
+	"__ledger__":        func() Payload { return new(ServerOnlyPayload) },
+	"__presence__":      func() Payload { return new(ServerOnlyPayload) },
+	"__trade__":         func() Payload { return new(ServerOnlyPayload) },
+	"__book__":          func() Payload { return new(ServerOnlyPayload) },
+}
+
+// DecodePayload decodes and validates msg.Value against the schema
+// registered for msg.Key. It returns a nil Payload for unreserved keys.
+func DecodePayload(msg *Msg) (Payload, error) {
+	schema, exists := payloadSchemas[msg.Key]
+	if !exists {
+		return nil, nil
+	}
+	payload := schema()
+	// Value has already been decoded into generic maps by the listener,
+	// round trip it through JSON to get at the typed fields
+	data, err := json.Marshal(msg.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, payload); err != nil {
+		return nil, fmt.Errorf("malformed value: %v", err)
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func validatePeriod(period *int) error {
+	if period == nil {
+		return errors.New("missing period")
+	}
+	if *period < 0 {
+		return fmt.Errorf("period %d is negative", *period)
+	}
+	return nil
+}
+
+// NoPayload is for control keys whose Value is ignored.
+type NoPayload struct{}
+
+func (p *NoPayload) UnmarshalJSON(data []byte) error { return nil }
+func (p *NoPayload) Validate() error                 { return nil }
+
+// ServerOnlyPayload rejects every message, for keys clients may not send.
+type ServerOnlyPayload struct{}
+
+func (p *ServerOnlyPayload) UnmarshalJSON(data []byte) error { return nil }
+func (p *ServerOnlyPayload) Validate() error {
+	return errors.New("key is reserved for the router")
+}
+
+type RegisterPayload struct {
+	UserID *string `json:"user_id"`
+}
+
+func (p *RegisterPayload) Validate() error {
+	if p.UserID == nil || *p.UserID == "" {
+		return errors.New("missing user_id")
+	}
+	return nil
+}
+
+// SetConfigPayload is the experiment configuration as uploaded by the admin:
+// a CSV document with one row per period/group.
+type SetConfigPayload struct {
+	CSV  string
+	Rows []map[string]string
+}
+
+func (p *SetConfigPayload) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &p.CSV)
+}
+
+func (p *SetConfigPayload) Validate() error {
+	reader := csv.NewReader(strings.NewReader(p.CSV))
+	// spreadsheet exports often drop trailing empty cells
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("config is not valid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return errors.New("config is empty")
+	}
+	header := records[0]
+	p.Rows = make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+		}
+		p.Rows = append(p.Rows, row)
+	}
+	return nil
+}
+
+type SetPeriodPayload struct {
+	Period *int `json:"period"`
+}
+
+func (p *SetPeriodPayload) Validate() error { return validatePeriod(p.Period) }
+
+type SetGroupPayload struct {
+	Group *int `json:"group"`
+}
+
+func (p *SetGroupPayload) Validate() error {
+	if p.Group == nil {
+		return errors.New("missing group")
+	}
+	if *p.Group < 0 {
+		return fmt.Errorf("group %d is negative", *p.Group)
+	}
+	return nil
+}
+
+type SetPagePayload struct {
+	Page *string `json:"page"`
+}
+
+func (p *SetPagePayload) Validate() error {
+	if p.Page == nil || *p.Page == "" {
+		return errors.New("missing page")
+	}
+	return nil
+}
+
+// AssignPayload moves subjects to a period, drawing their groups by the
+// matching scheme of the period. All subjects are moved if none are listed.
+type AssignPayload struct {
+	Period   *int     `json:"period"`
+	Subjects []string `json:"subjects"`
+}
+
+func (p *AssignPayload) Validate() error { return validatePeriod(p.Period) }
+
+// RevealPayload selects the sealed messages to reveal. Empty fields match
+// every sealed message.
+type RevealPayload struct {
+	Key    string `json:"key"`
+	Period int    `json:"period"`
+	Group  int    `json:"group"`
+}
+
+func (p *RevealPayload) Validate() error { return nil }
+
+// TimerPayload names a timer of the sender's period and group.
+type TimerPayload struct {
+	Name string `json:"name"`
+}
+
+func (p *TimerPayload) Validate() error {
+	if p.Name == "" {
+		return errors.New("missing timer name")
+	}
+	return nil
+}
+
+// StartTimerPayload starts a timer running for Duration milliseconds,
+// ticking every Interval milliseconds if that is set.
+type StartTimerPayload struct {
+	TimerPayload
+	Duration *int64 `json:"duration"`
+	Interval int64  `json:"interval"`
+}
+
+func (p *StartTimerPayload) Validate() error {
+	if err := p.TimerPayload.Validate(); err != nil {
+		return err
+	}
+	if p.Duration == nil || *p.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if p.Interval < 0 {
+		return fmt.Errorf("interval %d is negative", p.Interval)
+	}
+	return nil
+}
+
+// BarrierPayload names a barrier of the sender's period and group.
+type BarrierPayload struct {
+	Name string `json:"name"`
+}
+
+func (p *BarrierPayload) Validate() error {
+	if p.Name == "" {
+		return errors.New("missing barrier name")
+	}
+	return nil
+}
+
+// BidPayload is a bid in the auction of the sender's period and group.
+type BidPayload struct {
+	Price *float64 `json:"price"`
+}
+
+func (p *BidPayload) Validate() error { return validatePrice(p.Price) }
+
+// OrderPayload is an order in the double auction of the sender's period and
+// group. Quantity defaults to 1.
+type OrderPayload struct {
+	Side     string   `json:"side"`
+	Price    *float64 `json:"price"`
+	Quantity int      `json:"quantity"`
+}
+
+func (p *OrderPayload) Validate() error {
+	if p.Side != "buy" && p.Side != "sell" {
+		return fmt.Errorf("side %q is neither buy nor sell", p.Side)
+	}
+	if p.Quantity == 0 {
+		p.Quantity = 1
+	}
+	if p.Quantity < 0 {
+		return fmt.Errorf("quantity %d is negative", p.Quantity)
+	}
+	return validatePrice(p.Price)
+}
+
+// CancelPayload withdraws an order of the sender from the book.
+type CancelPayload struct {
+	ID *int `json:"id"`
+}
+
+func (p *CancelPayload) Validate() error {
+	if p.ID == nil {
+		return errors.New("missing order id")
+	}
+	return nil
+}
+
+// CloseMarketPayload selects the market the admin closes.
+type CloseMarketPayload struct {
+	Period *int `json:"period"`
+	Group  int  `json:"group"`
+}
+
+func (p *CloseMarketPayload) Validate() error { return validatePeriod(p.Period) }
+
+func validatePrice(price *float64) error {
+	if price == nil {
+		return errors.New("missing price")
+	}
+	if *price < 0 {
+		return fmt.Errorf("price %v is negative", *price)
+	}
+	return nil
+}
+
+// PeriodPayload is shared by the keys that only refer to a period.
+type PeriodPayload struct {
+	Period *int `json:"period"`
+}
+
+func (p *PeriodPayload) Validate() error { return validatePeriod(p.Period) }
+
+type SetPointsPayload struct {
+	Period *int     `json:"period"`
+	Points *float64 `json:"points"`
+}
+
+func (p *SetPointsPayload) Validate() error {
+	if p.Points == nil {
+		return errors.New("missing points")
+	}
+	return validatePeriod(p.Period)
+}
+
+type MarkPaidPayload struct {
+	Period *int  `json:"period"`
+	Paid   *bool `json:"paid"`
+}
+
+func (p *MarkPaidPayload) Validate() error {
+	if p.Paid == nil {
+		return errors.New("missing paid")
+	}
+	return validatePeriod(p.Period)
+}
+
+// AmountPayload is a single named amount, optionally for one period, as
+// used by the payout keys.
+type AmountPayload struct {
+	field  string
+	period bool
+	Amount *float64
+	Period *int
+}
+
+func (p *AmountPayload) UnmarshalJSON(data []byte) error {
+	var v map[string]json.RawMessage
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if raw, exists := v[p.field]; exists {
+		if err := json.Unmarshal(raw, &p.Amount); err != nil {
+			return err
+		}
+	}
+	if raw, exists := v["period"]; exists {
+		if err := json.Unmarshal(raw, &p.Period); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *AmountPayload) Validate() error {
+	if p.Amount == nil {
+		return errors.New("missing " + p.field)
+	}
+	if *p.Amount < 0 {
+		return fmt.Errorf("%s %v is negative", p.field, *p.Amount)
+	}
+	if p.period {
+		return validatePeriod(p.Period)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodePayload(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		{"__set_period__", `{"period": 2}`, true},
+		{"__set_period__", `{"period": -1}`, false},
+		{"__set_period__", `{"period": "2"}`, false},
+		{"__set_period__", `{"group": 2}`, false},
+		{"__set_period__", `"oops"`, false},
+		{"__set_group__", `{"group": 1}`, true},
+		{"__set_page__", `{"page": "Start"}`, true},
+		{"__set_page__", `{"page": 3}`, false},
+		{"__set_points__", `{"period": 1, "points": 2.5}`, true},
+		{"__set_points__", `{"period": 1}`, false},
+		{"__mark_paid__", `{"period": 1, "paid": true}`, true},
+		{"__mark_paid__", `{"period": 1, "paid": "yes"}`, false},
+		{"__pause__", `{"period": 3}`, true},
+		{"__set_config__", `"period,group\n1,1\n2,1"`, true},
+		{"__set_config__", `{"period": 1}`, false},
+		{"__set_show_up_fee__", `{"show_up_fee": 5}`, true},
+		{"__set_show_up_fee__", `{"conversion_rate": 5}`, false},
+		{"__reset__", `null`, true},
+		{"__error__", `"spoofed"`, false},
+		{"unreserved", `[1, 2, 3]`, true},
+	}
+	for _, test := range tests {
+		msg := &Msg{Key: test.key}
+		if err := json.Unmarshal([]byte(test.value), &msg.Value); err != nil {
+			t.Fatal(err)
+		}
+		_, err := DecodePayload(msg)
+		if test.valid && err != nil {
+			t.Errorf("%s %s: unexpected error %v", test.key, test.value, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s %s: expected an error", test.key, test.value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+	"websocket"
+)
+
+// connections that miss this many pings in a row are dropped
+const missedPings = 3
+
+// the reason heartbeats abort a listener's queue with
+const heartbeatTimeout = "heartbeat timeout"
+
+// Presence statuses of subjects, sent to the admin and observer connections
+// as __presence__ whenever a subject's connection comes or goes.
+const (
+	PresenceConnected    = "connected"
+	PresenceDisconnected = "disconnected"
+	PresenceReconnected  = "reconnected"
+)
+
+// HeartbeatLoop pings the connection every interval until done is closed.
+// If missedPings pings in a row go unanswered, the listener's queue is
+// aborted, which makes SendLoop close the connection. Missed pings are
+// counted rather than time since the last pong, so a stalled router doesn't
+// drop everyone at once. Connections that can't be pinged, i.e. hixie ones,
+// are left alone.
+func (l *Listener) HeartbeatLoop(interval time.Duration, done chan struct{}) {
+	if err := l.conn.Ping(nil); err == websocket.ErrNotSupported {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastPong, missed := atomic.LoadInt64(&l.lastPong), 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if pong := atomic.LoadInt64(&l.lastPong); pong != lastPong {
+			lastPong, missed = pong, 0
+		} else if missed++; missed >= missedPings {
+			l.queue.Abort(fmt.Sprintf("%s: %d pings unanswered", heartbeatTimeout, missed))
+			// unblock a SendLoop stuck writing to the dead peer
+			l.conn.SetDeadline(time.Now())
+			return
+		}
+		// pings wait for the write lock, so a stuck SendLoop doesn't hold
+		// up the timeout
+		go l.conn.Ping(nil)
+	}
+}
+
+// pong is called from ReceiveLoop, as the conn reads pongs.
+func (l *Listener) pong([]byte) {
+	atomic.StoreInt64(&l.lastPong, time.Now().UnixNano())
+}
+
+// addListener registers listener, replacing an earlier connection of the
+// same subject, and announces its presence.
+func (s *Session) addListener(listener *Listener) {
+	name := listener.subject.name
+	s.listeners[name] = listener
+	if listener.role != RoleSubject {
+		return
+	}
+	s.lock.Lock()
+	status := PresenceConnected
+	if _, seen := s.presence[name]; seen {
+		status = PresenceReconnected
+	}
+	s.presence[name] = status
+	s.lock.Unlock()
+	s.sendPresence(name, status)
+}
+
+// removeListener forgets a closed connection. The subject only counts as
+// disconnected if it hasn't connected again in the meantime.
+func (s *Session) removeListener(listener *Listener) {
+	name := listener.subject.name
+	if s.listeners[name] == listener {
+		delete(s.listeners, name)
+	}
+	if _, connected := s.listeners[name]; connected || listener.role != RoleSubject {
+		return
+	}
+	s.lock.Lock()
+	status, seen := s.presence[name]
+	if seen && status != PresenceDisconnected {
+		s.presence[name] = PresenceDisconnected
+	}
+	s.lock.Unlock()
+	if seen && status != PresenceDisconnected {
+		s.sendPresence(name, PresenceDisconnected)
+	}
+}
+
+// sendPresence delivers a __presence__ message to the admin and observer
+// connections. Like errors, presence is not persisted.
+func (s *Session) sendPresence(subject, status string) {
+	msg := &Msg{
+		Instance: s.instance,
+		Session:  s.id,
+		Nonce:    s.nonce,
+		Sender:   "server",
+		Time:     time.Now().UnixNano(),
+		Key:      "__presence__",
+		Value:    map[string]string{"subject": subject, "status": status},
+	}
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for name, listener := range s.listeners {
+		if listener.role == RoleSubject {
+			continue
+		}
+		if !listener.Send(msg, bytes) {
+			delete(s.listeners, name)
+		}
+	}
+}
+
+// Presence maps every subject that has connected to the session to its
+// last presence status. It is safe to call from outside the session loop.
+func (s *Session) Presence() map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	presence := make(map[string]string, len(s.presence))
+	for name, status := range s.presence {
+		presence[name] = status
+	}
+	return presence
+}
+
+// presence is the presence status sent to the listener in __queue_start__,
+// only admin and observer connections learn who else is online.
+func (l *Listener) presence(session *Session) map[string]string {
+	if l.role == RoleSubject {
+		return map[string]string{}
+	}
+	return session.Presence()
+}
+
+// RemoveListener tells the session that the connection of listener has
+// closed. A deleted session is not brought back for it.
+func (r *Router) RemoveListener(listener *Listener) {
+	r.lock.Lock()
+	session, exists := r.sessions[listener.instance][listener.session_id]
+	r.lock.Unlock()
+	if !exists {
+		return
+	}
+	select {
+	case session.closedListeners <- listener:
+	case <-session.done:
+	}
+}
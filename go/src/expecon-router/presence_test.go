@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"websocket"
+)
+
+func TestPresence(t *testing.T) {
+	router := NewRouter(NewMemoryDatabase(), Options{HeartbeatInterval: 100 * time.Millisecond})
+	server := httptest.NewServer(websocket.Server{Handler: func(c *websocket.Conn) {
+		router.HandleWebsocket(c)
+		c.Close()
+	}})
+	defer server.Close()
+	dial := func(name string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/redwood/1/" + name
+		conn, err := websocket.Dial(url, "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// reading answers the router's pings
+	presence := make(chan map[string]string, 10)
+	read := func(conn *websocket.Conn) {
+		decoder := json.NewDecoder(conn)
+		for {
+			var msg Msg
+			if err := decoder.Decode(&msg); err != nil {
+				return
+			}
+			if msg.Key == "__presence__" {
+				value := make(map[string]string)
+				for k, v := range msg.Value.(map[string]interface{}) {
+					value[k] = v.(string)
+				}
+				presence <- value
+			}
+		}
+	}
+	expect := func(subject, status string) {
+		select {
+		case value := <-presence:
+			if value["subject"] != subject || value["status"] != status {
+				t.Fatalf("expected %s %s, got %v", subject, status, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no presence for %s %s", subject, status)
+		}
+	}
+
+	admin := dial("admin")
+	defer admin.Close()
+	go read(admin)
+	responsive := dial("1")
+	defer responsive.Close()
+	go read(responsive)
+	expect("1", PresenceConnected)
+
+	// never reads, so never answers a ping
+	silent := dial("2")
+	expect("2", PresenceConnected)
+	expect("2", PresenceDisconnected)
+	silent.Close()
+
+	reconnected := dial("2")
+	defer reconnected.Close()
+	go read(reconnected)
+	expect("2", PresenceReconnected)
+
+	time.Sleep(100 * time.Millisecond)
+	session := router.Session("redwood", 1)
+	if p := session.Presence(); p["1"] != PresenceConnected || p["2"] != PresenceReconnected || len(p) != 2 {
+		t.Fatalf("unexpected presence %v", p)
+	}
+	if listeners := router.SessionStatus("redwood", 1).Listeners; len(listeners) != 3 {
+		t.Fatalf("expected admin and both subjects to stay connected, got %d listeners", len(listeners))
+	}
+}
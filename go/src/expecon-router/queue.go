@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type OverflowPolicy int
+
+const (
+	// drop the oldest queued StateUpdate message, or else the oldest
+	// experiment message. A queue holding only control messages, which
+	// clients can't do without, disconnects the client instead.
+	DropOldest OverflowPolicy = iota
+	// replace a queued message with the same key and sender
+	Coalesce
+	// disconnect the client, it will resync when it reconnects
+	Disconnect
+)
+
+func (policy OverflowPolicy) String() string {
+	switch policy {
+	case Coalesce:
+		return "coalesce"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "drop-oldest"
+}
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	for _, policy := range []OverflowPolicy{DropOldest, Coalesce, Disconnect} {
+		if strings.EqualFold(s, policy.String()) {
+			return policy, nil
+		}
+	}
+	return DropOldest, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+type queuedMessage struct {
+	raw         []byte
+	key         string
+	sender      string
+	stateUpdate bool
+}
+
+// SendQueue is a bounded queue of encoded messages, safe for one producer
+// (the session loop) and one consumer (the listener's SendLoop). Delivery
+// must never block the session loop, so when a client falls behind the
+// overflow policy decides what to give up.
+type SendQueue struct {
+	lock     sync.Mutex
+	ready    chan struct{} // signalled when messages are pushed or the queue closes
+	messages []*queuedMessage
+	limit    int
+	policy   OverflowPolicy
+	syncing  bool
+	closed   bool
+	reason   string // why the queue was closed, if not by the consumer
+	drain    string // close for this reason once the queue is empty
+	dropped  int
+}
+
+func NewSendQueue(limit int, policy OverflowPolicy) *SendQueue {
+	return &SendQueue{
+		ready:   make(chan struct{}, 1),
+		limit:   limit,
+		policy:  policy,
+		syncing: true,
+	}
+}
+
+// Push queues raw, the encoding of msg. It returns false if the queue is
+// closed, either before or because of this push.
+func (q *SendQueue) Push(msg *Msg, raw []byte) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	queued := &queuedMessage{raw: raw, key: msg.Key, sender: msg.Sender, stateUpdate: msg.StateUpdate}
+	// live messages pile up while the listener syncs, which is bounded by
+	// the length of the sync rather than by a slow client
+	if !q.syncing && len(q.messages) >= q.limit && !q.makeRoom(queued) {
+		q.close(fmt.Sprintf("send queue full (%d messages, policy %s)", len(q.messages), q.policy))
+		return false
+	}
+	q.messages = append(q.messages, queued)
+	q.signal()
+	return true
+}
+
+// makeRoom applies the overflow policy to a full queue, reporting whether
+// it freed a slot for queued. q.lock must be held.
+func (q *SendQueue) makeRoom(queued *queuedMessage) bool {
+	switch q.policy {
+	case DropOldest:
+		return q.dropFirst(func(old *queuedMessage) bool { return old.stateUpdate }) ||
+			q.dropFirst(func(old *queuedMessage) bool { return !IsReservedKey(old.key) })
+	case Coalesce:
+		// control messages are never coalesced away
+		return q.dropFirst(func(old *queuedMessage) bool {
+			return old.key == queued.key && old.sender == queued.sender && !IsReservedKey(old.key)
+		})
+	}
+	return false
+}
+
+// dropFirst discards the oldest queued message selected by discard,
+// reporting whether there was one. q.lock must be held.
+func (q *SendQueue) dropFirst(discard func(*queuedMessage) bool) bool {
+	for i, old := range q.messages {
+		if discard(old) {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			q.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+func (q *SendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Synced lifts the size limit that is waived during the initial sync.
+// Anything above the limit by then is handled like any later overflow, so
+// a client that can't keep up from the start doesn't get a pass.
+func (q *SendQueue) Synced() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.syncing = false
+	for len(q.messages) > q.limit && !q.closed {
+		excess := q.messages[len(q.messages)-1]
+		q.messages = q.messages[:len(q.messages)-1]
+		if !q.makeRoom(excess) {
+			q.close(fmt.Sprintf("send queue full after sync (%d messages, policy %s)", len(q.messages)+1, q.policy))
+			break
+		}
+		q.messages = append(q.messages, excess)
+	}
+}
+
+// Pop waits for the next message. Once the queue is closed it returns the
+// reason, which is empty if the consumer closed it.
+func (q *SendQueue) Pop() (raw []byte, reason string, ok bool) {
+	for {
+		q.lock.Lock()
+		if q.closed {
+			q.lock.Unlock()
+			return nil, q.reason, false
+		}
+		if len(q.messages) > 0 {
+			raw = q.messages[0].raw
+			q.messages[0] = nil
+			q.messages = q.messages[1:]
+			q.lock.Unlock()
+			return raw, "", true
+		}
+		if q.drain != "" {
+			q.close(q.drain)
+			q.lock.Unlock()
+			return nil, q.reason, false
+		}
+		q.lock.Unlock()
+		<-q.ready
+	}
+}
+
+// Close discards any queued messages. Later pushes fail.
+func (q *SendQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.close("")
+}
+
+func (q *SendQueue) close(reason string) {
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.reason = reason
+	q.messages = nil
+	q.signal()
+}
+
+// Dropped returns the number of messages discarded by the overflow policy.
+func (q *SendQueue) Dropped() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+// Abort closes the queue for reason, as if it had overflowed.
+func (q *SendQueue) Abort(reason string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.close(reason)
+}
+
+// Drain closes the queue for reason once the messages queued so far, and
+// any pushed in the meantime, have been sent.
+func (q *SendQueue) Drain(reason string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.drain == "" {
+		q.drain = reason
+	}
+	q.signal()
+}
+
+// Reason returns why the queue was closed, empty if it is open or the
+// consumer closed it.
+func (q *SendQueue) Reason() string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.reason
+}
+
+// Len returns the number of messages waiting to be sent.
+func (q *SendQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.messages)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func pushTestMessage(q *SendQueue, key, sender string, stateUpdate bool, value int) bool {
+	msg := &Msg{Key: key, Sender: sender, StateUpdate: stateUpdate}
+	return q.Push(msg, []byte(fmt.Sprintf("%s/%s/%d", key, sender, value)))
+}
+
+func drainQueue(q *SendQueue) []string {
+	var raws []string
+	for q.Len() > 0 {
+		raw, _, _ := q.Pop()
+		raws = append(raws, string(raw))
+	}
+	return raws
+}
+
+func checkQueue(t *testing.T, q *SendQueue, expected ...string) {
+	raws := drainQueue(q)
+	if fmt.Sprint(raws) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, raws)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	q := NewSendQueue(3, DropOldest)
+	q.Synced()
+	pushTestMessage(q, "event", "1", false, 0)
+	pushTestMessage(q, "pos", "1", true, 1)
+	pushTestMessage(q, "pos", "2", true, 2)
+	if !pushTestMessage(q, "pos", "1", true, 3) {
+		t.Fatal("push failed")
+	}
+	checkQueue(t, q, "event/1/0", "pos/2/2", "pos/1/3")
+	if q.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped message, got %d", q.Dropped())
+	}
+
+	// without StateUpdate messages the oldest event goes, control
+	// messages stay
+	pushTestMessage(q, "__set_period__", "1", false, 0)
+	pushTestMessage(q, "event", "1", false, 1)
+	pushTestMessage(q, "event", "1", false, 2)
+	if !pushTestMessage(q, "event", "1", false, 3) {
+		t.Fatal("push failed")
+	}
+	checkQueue(t, q, "__set_period__/1/0", "event/1/2", "event/1/3")
+
+	// nothing left that may be dropped
+	for i := 0; i < 3; i++ {
+		pushTestMessage(q, "__set_period__", "1", false, i)
+	}
+	if pushTestMessage(q, "pos", "1", true, 4) {
+		t.Fatal("push into a queue of control messages succeeded")
+	}
+	if _, reason, ok := q.Pop(); ok || reason == "" {
+		t.Fatalf("expected queue to be closed with a reason, got %q", reason)
+	}
+}
+
+func TestSendQueueCoalesce(t *testing.T) {
+	q := NewSendQueue(3, Coalesce)
+	q.Synced()
+	pushTestMessage(q, "pos", "1", false, 0)
+	pushTestMessage(q, "pos", "2", false, 1)
+	pushTestMessage(q, "__set_period__", "1", false, 2)
+	if !pushTestMessage(q, "pos", "1", false, 3) {
+		t.Fatal("push failed")
+	}
+	checkQueue(t, q, "pos/2/1", "__set_period__/1/2", "pos/1/3")
+
+	pushTestMessage(q, "__set_period__", "1", false, 0)
+	pushTestMessage(q, "__set_period__", "1", false, 1)
+	pushTestMessage(q, "pos", "1", false, 2)
+	if pushTestMessage(q, "__set_period__", "1", false, 3) {
+		t.Fatal("control message was coalesced")
+	}
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	q := NewSendQueue(1, Disconnect)
+	pushTestMessage(q, "pos", "1", true, 0)
+	// no limit during sync
+	if !pushTestMessage(q, "pos", "1", true, 1) {
+		t.Fatal("push failed during sync")
+	}
+	q.Synced()
+	if _, reason, ok := q.Pop(); ok || reason == "" {
+		t.Fatalf("expected queue to be closed with a reason, got %q", reason)
+	}
+	if pushTestMessage(q, "pos", "1", true, 2) {
+		t.Fatal("push into a closed queue succeeded")
+	}
+}
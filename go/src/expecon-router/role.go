@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+)
+
+type Role int
+
+const (
+	RoleSubject Role = iota
+	RoleAdmin
+	RoleObserver
+)
+
+func (role Role) String() string {
+	switch role {
+	case RoleAdmin:
+		return "admin"
+	case RoleObserver:
+		return "observer"
+	}
+	return "subject"
+}
+
+// RoleFor returns the role of a connection made as the named subject.
+// "admin" is the experimenter's control page, "listener" is used by the
+// read-only admin pages such as data and payouts.
+func RoleFor(name string) Role {
+	switch name {
+	case "admin":
+		return RoleAdmin
+	case "listener":
+		return RoleObserver
+	}
+	return RoleSubject
+}
+
+// IsReservedKey reports whether key belongs to the framework rather than
+// to an experiment.
+func IsReservedKey(key string) bool {
+	return len(key) > 4 && strings.HasPrefix(key, "__") && strings.HasSuffix(key, "__")
+}
+
+type Policy struct {
+	sendAll      bool            // may send any key
+	sendData     bool            // may send unreserved experiment keys
+	sendReserved map[string]bool // reserved keys that may be sent
+	receiveAll   bool            // receives every message, regardless of period and group
+	override     bool            // may choose the period and group of its messages
+	delegate     bool            // may send on behalf of another subject
+}
+
+func (p *Policy) CanSend(key string) bool {
+	if p.sendAll {
+		return true
+	}
+	if IsReservedKey(key) {
+		return p.sendReserved[key]
+	}
+	return p.sendData
+}
+
+var policies = map[Role]*Policy{
+	RoleSubject: &Policy{
+		sendData: true,
+		sendReserved: map[string]bool{
+			"__set_period__":             true,
+			"__set_group__":              true,
+			"__set_page__":               true,
+			"__set_points__":             true,
+			"__set_conversion_rate__":    true,
+			"__set_show_up_fee__":        true,
+			"__set_lottery_conversion__": true,
+			"__set_lottery_pay__":        true,
+			"__paused__":                 true,
+			"__resumed__":                true,
+			"__get_period__":             true,
+			"__page_loaded__":            true,
+			"__page_refresh__":           true,
+			"__member_synced__":          true,
+			"__start_timer__":            true,
+			"__ready__":                  true,
+			"__get_ledger__":             true,
+			"__bid__":                    true,
+			"__order__":                  true,
+			"__cancel__":                 true,
+		},
+	},
+	RoleAdmin: &Policy{
+		sendAll:    true,
+		receiveAll: true,
+		override:   true,
+		delegate:   true,
+	},
+	RoleObserver: &Policy{
+		sendReserved: map[string]bool{
+			"__get_period__": true,
+			"__get_ledger__": true,
+		},
+		receiveAll: true,
+	},
+}
@@ -1,47 +1,59 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"websocket"
 )
 
-type ListenerRequest struct {
-	listener *Listener
-	ack      chan bool
-}
-
+// Router owns the sessions and dispatches to them. Each session runs its
+// own event loop, so sessions never wait on each other.
 type Router struct {
-	messages        chan *Msg
-	newListeners    chan *ListenerRequest
-	requestSubject  chan *SubjectRequest
-	removeListeners chan *Listener
-	sessions        map[string]map[int]*Session
-	db              *Database
+	sessions    map[string]map[int]*Session
+	lock        sync.Mutex
+	db          Database
+	secret      []byte
+	queueSize   int
+	overflow    OverflowPolicy
+	heartbeat   time.Duration
+	metrics     *Metrics
+	draining    bool           // set by Shutdown, guarded by lock
+	connections sync.WaitGroup // open websocket connections
 }
 
-func NewRouter(redis_host string, redis_db int) (r *Router) {
+func NewRouter(db Database, options Options) (r *Router) {
 	r = new(Router)
-	r.messages = make(chan *Msg, 100)
-	r.newListeners = make(chan *ListenerRequest, 100)
-	r.removeListeners = make(chan *Listener, 100)
-	r.requestSubject = make(chan *SubjectRequest, 100)
+	if options.Secret != "" {
+		r.secret = []byte(options.Secret)
+	}
 	r.sessions = make(map[string]map[int]*Session)
+	r.queueSize = options.QueueSize
+	if r.queueSize <= 0 {
+		r.queueSize = DefaultQueueSize
+	}
+	r.overflow = options.Overflow
+	r.heartbeat = options.HeartbeatInterval
+	r.metrics = NewMetrics()
 
-	r.db = NewDatabase(redis_host, redis_db)
-	// populate the in-memory queues with persisted redis data
+	r.db = db
+	if redisDB, ok := db.(*RedisDatabase); ok {
+		redisDB.SetObserver(r.metrics.ObserveRedis)
+	}
+	// populate the in-memory queues with persisted data
 
 	sessionIDs, err := r.db.SessionIDs()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("loading %d sessions from redis", len(sessionIDs))
+	log.Printf("loading %d sessions from the database", len(sessionIDs))
 	for _, sessionID := range sessionIDs {
 
 		session := r.Session(sessionID.instance, sessionID.id)
@@ -51,6 +63,15 @@ func NewRouter(redis_host string, redis_db int) (r *Router) {
 		}
 		for _, objectID := range sessionObjectIDs {
 
+			// objects of the whole session rather than of a subject
+			switch objectID.objectType {
+			case "matching", "timers", "barriers", "ledger", "sealed", "markets":
+				if err := session.loadObject(objectID); err != nil {
+					log.Print(err)
+				}
+				continue
+			}
+
 			subject := objectID.subject
 			if session.subjects[subject] == nil {
 				session.subjects[subject] = &Subject{name: subject}
@@ -60,19 +81,38 @@ func NewRouter(redis_host string, redis_db int) (r *Router) {
 			case "period":
 				period, err := r.db.Period(objectID)
 				if err != nil {
-					panic(err)
+					log.Print(err)
+					continue
 				}
 				session.subjects[subject].period = period
 			case "group":
 				group, err := r.db.Group(objectID)
 				if err != nil {
-					panic(err)
+					log.Print(err)
+					continue
 				}
 				session.subjects[subject].group = group
+			case "paused":
+				period, err := r.db.Paused(objectID)
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				if period >= 0 {
+					session.paused[subject] = period
+				}
+			case "page":
+				page, err := r.db.SessionObject(objectID)
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				session.subjects[subject].page = string(page)
 			case "config":
 				config, err := r.db.Config(objectID)
 				if err != nil {
-					panic(err)
+					log.Print(err)
+					continue
 				}
 				session.last_cfg = config
 			}
@@ -81,7 +121,11 @@ func NewRouter(redis_host string, redis_db int) (r *Router) {
 	return r
 }
 
+// Session returns the session for instance/id, creating it and starting
+// its event loop if it doesn't exist yet.
 func (r *Router) Session(instance string, id int) *Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	instance_sessions, exists := r.sessions[instance]
 	if !exists {
 		instance_sessions = make(map[int]*Session)
@@ -91,184 +135,291 @@ func (r *Router) Session(instance string, id int) *Session {
 	if !exists {
 		session = NewSession(r, instance, id)
 		instance_sessions[id] = session
+		go session.Run()
 	}
 	return session
 }
 
-// handle receives messages on the given websocket connection, decoding them
-// from JSON to a Msg object. It adds a channel to listeners, encoding messages
-// received on the listener channel as JSON, then sending it over the connection.
-func (r *Router) HandleWebsocket(c *websocket.Conn) {
-	u, err := url.Parse(c.LocalAddr().String())
-	if err != nil {
-		log.Println(err)
-		return
+// Sessions returns every session currently known to the router.
+func (r *Router) Sessions() []*Session {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var sessions []*Session
+	for _, instance_sessions := range r.sessions {
+		for _, session := range instance_sessions {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// hasSession reports whether the router knows the session, without
+// creating it.
+func (r *Router) hasSession(instance string, session_id int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, exists := r.sessions[instance][session_id]
+	return exists
+}
+
+// removeSession forgets session, unless it has already been replaced.
+func (r *Router) removeSession(session *Session) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.sessions[session.instance][session.id] == session {
+		delete(r.sessions[session.instance], session.id)
 	}
+}
 
-	// split url path into components, e.g.
-	// url: http://leeps.ucsc.edu/redwood/session/1/subject1@example.com
-	// path: /redwood/session/1/subject1@example.com
-	// -> [redwood, session, 1, subject1@example.com]
+// parseLocation splits a websocket url path into instance prefix, session
+// id and subject name, e.g.
+// url: http://leeps.ucsc.edu/redwood/session/1/subject1@example.com
+// path: /redwood/session/1/subject1@example.com
+// -> [redwood, session, 1, subject1@example.com]
+func parseLocation(u *url.URL) (instance string, session_id int, subject_name string, err error) {
 	components := strings.Split(u.Path, "/")
 
 	// map components into instance_prefix, session_id, and subject_name
-	var instance, session_id_string, subject_name string
+	var session_id_string string
 	if len(components) >= 4 {
 		instance = components[1]
 		session_id_string = components[2]
 		subject_name = components[3]
-	} else {
+	} else if len(components) == 3 {
 		session_id_string = components[1]
 		subject_name = components[2]
+	} else {
+		return "", 0, "", fmt.Errorf("malformed path %q", u.Path)
+	}
+
+	session_id, err = strconv.Atoi(session_id_string)
+	return instance, session_id, subject_name, err
+}
+
+// parseSyncCursor reads the optional nonce, since and index query
+// parameters of a reconnecting client. It returns nil if there is no nonce.
+func parseSyncCursor(query url.Values) (cursor *SyncCursor, err error) {
+	nonce := query.Get("nonce")
+	if nonce == "" {
+		return nil, nil
+	}
+	cursor = &SyncCursor{Nonce: nonce}
+	if since := query.Get("since"); since != "" {
+		if cursor.Since, err = strconv.ParseInt(since, 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed since %q", since)
+		}
+	}
+	if index := query.Get("index"); index != "" {
+		if cursor.Index, err = strconv.Atoi(index); err != nil || cursor.Index < 0 {
+			return nil, fmt.Errorf("malformed index %q", index)
+		}
+	}
+	return cursor, nil
+}
+
+// HandshakeWebsocket authenticates a connection before it is upgraded. The
+// signed token may be given as a "token" query parameter, as a subprotocol
+// prefixed with TokenProtocolPrefix, or in a redwood_token_<session>_<subject>
+// cookie set by the Django app. Without a secret every connection is allowed.
+func (r *Router) HandshakeWebsocket(config *websocket.Config, req *http.Request) error {
+	token := req.URL.Query().Get("token")
+	// only ever select the token subprotocol, browsers fail the connection
+	// if the server answers with one they did not offer
+	protocols := config.Protocol
+	config.Protocol = nil
+	for _, protocol := range protocols {
+		if strings.HasPrefix(protocol, TokenProtocolPrefix) {
+			token = strings.TrimPrefix(protocol, TokenProtocolPrefix)
+			config.Protocol = []string{protocol}
+			break
+		}
+	}
+	if r.secret == nil {
+		return nil
 	}
 
-	session_id, err := strconv.Atoi(session_id_string)
+	instance, session_id, subject_name, err := parseLocation(config.Location)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		if cookie, err := req.Cookie(fmt.Sprintf("redwood_token_%d_%s", session_id, subject_name)); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		err = errors.New("missing token")
+	} else {
+		var claims *TokenClaims
+		if claims, err = VerifyToken(r.secret, token, time.Now()); err == nil {
+			err = claims.Permits(instance, session_id, subject_name)
+		}
+	}
+	if err != nil {
+		log.Printf("rejected connection to %s: %v", config.Location.Path, err)
+	}
+	return err
+}
+
+// authorize checks the token of an HTTP request for the session against
+// the names it may act as. Like for websockets, the token is taken from the
+// token query parameter, a bearer Authorization header or a cookie.
+func (r *Router) authorize(req *http.Request, instance string, session_id int, names ...string) error {
+	if r.secret == nil {
+		return nil
+	}
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	for _, name := range names {
+		if token == "" {
+			if cookie, err := req.Cookie(fmt.Sprintf("redwood_token_%d_%s", session_id, name)); err == nil {
+				token = cookie.Value
+			}
+		}
+	}
+	if token == "" {
+		return errors.New("missing token")
+	}
+	claims, err := VerifyToken(r.secret, token, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if claims.Permits(instance, session_id, name) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("token is for %s/%d/%s", claims.Instance, claims.Session, claims.Subject)
+}
+
+// handle receives messages on the given websocket connection, decoding them
+// from JSON to a Msg object. It adds a channel to listeners, encoding messages
+// received on the listener channel as JSON, then sending it over the connection.
+func (r *Router) HandleWebsocket(c *websocket.Conn) {
+	r.connections.Add(1)
+	defer r.connections.Done()
+	u, err := url.Parse(c.LocalAddr().String())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	instance, session_id, subject_name, err := parseLocation(u)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	role := RoleFor(subject_name)
 	var subject *Subject
-	if subject_name == "admin" || subject_name == "listener" {
+	if role != RoleSubject {
 		subject = &Subject{name: subject_name, period: -1, group: -1}
 	} else {
-		// put in a request to the server loop for the given subject object
+		// put in a request to the session loop for the given subject object
 		// this ensures only one subject object exists per session/name pair
-		request := &SubjectRequest{instance: instance, session: session_id, name: subject_name, response: make(chan *Subject)}
-		r.requestSubject <- request
-		subject = <-request.response
+		subject = r.RequestSubject(instance, session_id, subject_name)
+	}
+
+	// clients may pick their own overflow policy, e.g. continuous-time
+	// games that only care about the latest update from each subject
+	overflow := r.overflow
+	if name := u.Query().Get("overflow"); name != "" {
+		if overflow, err = ParseOverflowPolicy(name); err != nil {
+			log.Println(err)
+			overflow = r.overflow
+		}
 	}
-	if subject == nil {
-		log.Panicln("nil subject")
+
+	// a malformed cursor costs a full replay, not the connection
+	cursor, err := parseSyncCursor(u.Query())
+	if err != nil {
+		log.Println(err)
 	}
 
-	listener := NewListener(r, instance, session_id, subject, c)
-	ack := make(chan bool)
-	r.newListeners <- &ListenerRequest{listener, ack}
+	listener := NewListener(r, instance, session_id, subject, role, overflow, c)
 	// wait for listener to be registered before starting sync
-	<-ack
+	r.AddListener(listener)
+	sessionID := SessionID{instance, session_id}
+	r.metrics.Connected(sessionID)
 
 	log.Printf("STARTED SYNC: %s\n", subject.name)
-	listener.Sync()
+	listener.Sync(cursor)
 	log.Printf("FINISHED SYNC: %s\n", subject.name)
+	listener.queue.Synced()
+	if r.Draining() {
+		// connected while the sessions were being drained
+		listener.queue.Drain(ShutdownReason)
+	}
 
+	done := make(chan struct{})
+	if r.heartbeat > 0 {
+		go listener.HeartbeatLoop(r.heartbeat, done)
+	}
 	go listener.SendLoop()
 	listener.ReceiveLoop()
+	close(done)
+	// stops SendLoop
+	listener.queue.Close()
+	r.RemoveListener(listener)
+	reason := "client"
+	switch queueReason := listener.queue.Reason(); {
+	case strings.HasPrefix(queueReason, heartbeatTimeout):
+		reason = "timeout"
+	case queueReason == ShutdownReason:
+		reason = "shutdown"
+	case queueReason != "":
+		reason = "overflow"
+	}
+	r.metrics.Disconnected(sessionID, reason)
 }
 
-func (r *Router) HandleMessage(msg *Msg) {
-	var err error
-	msg.Time = time.Now().UnixNano()
-	session := r.Session(msg.Instance, msg.Session)
-	if msg.Nonce != session.nonce {
-		return
-	}
-	if msg.StateUpdate {
-		session.lock.Lock()
-		last_msgs, exists := session.last_state_update[msg.Key]
-		if !exists {
-			last_msgs = make(map[string]*Msg)
-			session.last_state_update[msg.Key] = last_msgs
+// RequestSubject returns the subject object for name, registering the
+// subject with the session if it is new.
+func (r *Router) RequestSubject(instance string, session_id int, name string) *Subject {
+	for {
+		session := r.Session(instance, session_id)
+		request := &SubjectRequest{instance: instance, session: session_id, name: name, response: make(chan *Subject, 1)}
+		select {
+		case session.requestSubject <- request:
+			return <-request.response
+		case <-session.done:
+			// deleted in the meantime, try again with its replacement
 		}
-		last_msgs[msg.Sender] = msg
-		session.lock.Unlock()
-	}
-
-	sessionID := SessionID{instance: msg.Instance, id: msg.Session}
-	objectID := SessionObjectID{
-		objectType: "",
-		sessionID:  sessionID,
-		subject:    msg.Sender,
 	}
+}
 
-	switch msg.Key {
-	case "__set_period__":
-		v := msg.Value.(map[string]interface{})
-		subject := session.subjects[msg.Sender]
-		subject.period = int(v["period"].(float64))
-		msg.Period = int(v["period"].(float64))
-		period_bytes := fmt.Sprintf("%d", subject.period)
-
-		objectID.objectType = "period"
-		if r.db.SetSessionObject(objectID, []byte(period_bytes)); err != nil {
-			panic(err)
-		}
-	case "__set_group__":
-		v := msg.Value.(map[string]interface{})
-		subject := session.subjects[msg.Sender]
-		subject.group = int(v["group"].(float64))
-		msg.Group = int(v["group"].(float64))
-		group_bytes := fmt.Sprintf("%d", subject.group)
-
-		objectID.objectType = "group"
-		if r.db.SetSessionObject(objectID, []byte(group_bytes)); err != nil {
-			panic(err)
-		}
-	case "__set_page__":
-		page_bytes := []byte(msg.Value.(map[string]interface{})["page"].(string))
-
-		objectID.objectType = "page"
-		if r.db.SetSessionObject(objectID, []byte(page_bytes)); err != nil {
-			panic(err)
-		}
-	case "__set_config__":
-		session.last_cfg = msg
-		config_bytes, err := json.Marshal(msg)
-		if err != nil {
-			panic(err)
-		}
-
-		objectID.objectType = "config"
-		if r.db.SetSessionObject(objectID, []byte(config_bytes)); err != nil {
-			panic(err)
+// AddListener registers listener with its session and returns once the
+// listener will receive all further messages.
+func (r *Router) AddListener(listener *Listener) {
+	for {
+		session := r.Session(listener.instance, listener.session_id)
+		request := &ListenerRequest{listener: listener, ack: make(chan bool, 1)}
+		select {
+		case session.newListeners <- request:
+			<-request.ack
+			return
+		case <-session.done:
 		}
-	case "__reset__":
-		session.Reset()
-	case "__delete__":
-		session.Delete()
 	}
+}
 
-	if err == nil {
-		session.Receive(msg)
-	} else {
-		errMsg := &Msg{
-			Instance: msg.Instance,
-			Session:  msg.Session,
-			Sender:   "server",
-			Period:   0,
-			Group:    0,
-			Time:     time.Now().UnixNano(),
-			Key:      "__error__",
-			Value:    err.Error()}
-		session.Receive(errMsg)
+// Dispatch hands msg to the event loop of its session.
+func (r *Router) Dispatch(msg *Msg) {
+	session := r.Session(msg.Instance, msg.Session)
+	select {
+	case session.messages <- msg:
+	case <-session.done:
+		// the session was deleted, so msg has a stale nonce anyway
 	}
 }
 
-// route listens for incoming messages, routing them to applicable listeners.
-// handles control messages
-func (r *Router) Route() {
-	for {
-		select {
-		case request := <-r.newListeners:
-			listener := request.listener
-			session := r.Session(listener.instance, listener.session_id)
-			session.listeners[listener.subject.name] = listener
-			request.ack <- true
-
-		case request := <-r.requestSubject:
-			session := r.Session(request.instance, request.session)
-			request.response <- session.Subject(request.name)
-
-		case msg := <-r.messages:
-			r.HandleMessage(msg)
-
-		case listener := <-r.removeListeners:
-			session := r.Session(listener.instance, listener.session_id)
-			for id := range session.listeners {
-				if listener == session.listeners[id] {
-					delete(session.listeners, id)
-				}
-			}
-		}
+// ReportError sends err to sender and admin of the given session as an
+// __error__ message. It is safe to call from outside the session loop.
+func (r *Router) ReportError(instance string, session_id int, sender string, err error) {
+	session := r.Session(instance, session_id)
+	select {
+	case session.errorReports <- &ErrorReport{sender: sender, err: err}:
+	case <-session.done:
 	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"websocket"
+)
+
+func TestStampRouting(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	session := router.Session("redwood", 1)
+	router.RequestSubject("redwood", 1, "1")
+	nonce := session.Nonce()
+	send := func(msg *Msg) {
+		msg.Instance = "redwood"
+		msg.Session = 1
+		msg.Nonce = nonce
+		router.Dispatch(msg)
+	}
+	send(&Msg{Sender: "admin", Key: "__set_config__", Value: "period,matching,group_size\n1,fixed,2\n2,fixed,2"})
+	send(&Msg{Sender: "1", Key: "__set_period__", Value: map[string]interface{}{"period": 2}})
+	send(&Msg{Sender: "1", Period: 1, Group: 3, Key: "bid", Value: 1})
+	send(&Msg{Sender: "1", Period: 0, Group: 3, Key: "ready", Value: true})
+	send(&Msg{Sender: "admin", Period: 1, Group: 3, Override: true, Key: "announce", Value: "hi"})
+	send(&Msg{Sender: "admin", Period: 0, Override: true, Key: "everyone", Value: "hi"})
+	router.SessionStatus("redwood", 1)
+
+	messages, err := db.Messages(SessionID{"redwood", 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][2]int{"bid": {2, 1}, "ready": {2, 1}, "announce": {1, 3}, "everyone": {0, 0}}
+	for msg := range messages {
+		if routing, exists := expected[msg.Key]; exists {
+			if msg.Period != routing[0] || msg.Group != routing[1] {
+				t.Errorf("%s routed to period %d group %d, expected %v", msg.Key, msg.Period, msg.Group, routing)
+			}
+			delete(expected, msg.Key)
+		}
+	}
+	if len(expected) != 0 {
+		t.Fatalf("messages %v not saved", expected)
+	}
+}
+
+func TestSubjectOverride(t *testing.T) {
+	if policies[RoleSubject].override || policies[RoleObserver].override || !policies[RoleAdmin].override {
+		t.Fatal("only admins may override routing")
+	}
+}
+
+func TestSenderIdentity(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	server := httptest.NewServer(websocket.Server{Handler: func(c *websocket.Conn) {
+		router.HandleWebsocket(c)
+		c.Close()
+	}})
+	defer server.Close()
+	nonce := router.Session("redwood", 1).Nonce()
+	send := func(name string, msg *Msg) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/redwood/1/" + name
+		conn, err := websocket.Dial(url, "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		msg.Nonce = nonce
+		if err := json.NewEncoder(conn).Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("1", &Msg{Sender: "2", Origin: "2", Key: "spoofed", Value: 1})
+	send("admin", &Msg{Sender: "1", Key: "__set_points__", Value: map[string]interface{}{"period": 1, "points": 5}})
+
+	found := make(map[string]*Msg)
+	for deadline := time.Now().Add(time.Second); len(found) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		router.SessionStatus("redwood", 1)
+		messages, err := db.Messages(SessionID{"redwood", 1}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for msg := range messages {
+			if msg.Key == "spoofed" || msg.Key == "__set_points__" {
+				found[msg.Key] = msg
+			}
+		}
+	}
+	if msg := found["spoofed"]; msg == nil || msg.Sender != "1" || msg.Origin != "" {
+		t.Errorf("subject sent as %+v", msg)
+	}
+	if msg := found["__set_points__"]; msg == nil || msg.Sender != "1" || msg.Origin != "admin" {
+		t.Errorf("admin delegation saved as %+v", msg)
+	}
+}
+
+func TestDirectedMessages(t *testing.T) {
+	router := NewRouter(NewMemoryDatabase(), Options{})
+	server := httptest.NewServer(websocket.Server{Handler: func(c *websocket.Conn) {
+		router.HandleWebsocket(c)
+		c.Close()
+	}})
+	defer server.Close()
+	nonce := router.Session("redwood", 1).Nonce()
+	send := func(key string, recipients ...string) {
+		router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Key: key, Value: 1, Recipients: recipients})
+	}
+	// received returns the experiment keys decoded before the until message
+	received := func(decoder *json.Decoder, until string) []string {
+		var keys []string
+		for {
+			var msg Msg
+			if err := decoder.Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Key == until {
+				return keys
+			}
+			if !IsReservedKey(msg.Key) {
+				keys = append(keys, msg.Key)
+			}
+		}
+	}
+	dial := func(name string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/redwood/1/" + name
+		conn, err := websocket.Dial(url, "", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	send("offer", "2")
+	send("signal", "2", "3")
+	send("hello")
+	router.SessionStatus("redwood", 1)
+	expected := map[string]string{"1": "[offer signal hello]", "2": "[offer signal hello]", "3": "[signal hello]", "4": "[hello]", "admin": "[offer signal hello]"}
+	decoders := make(map[string]*json.Decoder)
+	for name, keys := range expected {
+		conn := dial(name)
+		defer conn.Close()
+		decoders[name] = json.NewDecoder(conn)
+		if replayed := fmt.Sprint(received(decoders[name], "__queue_end__")); replayed != keys {
+			t.Errorf("%s replayed %s, expected %s", name, replayed, keys)
+		}
+	}
+
+	send("offer", "4")
+	send("done")
+	expected = map[string]string{"1": "[offer]", "2": "[]", "3": "[]", "4": "[offer]", "admin": "[offer]"}
+	for name, keys := range expected {
+		if live := fmt.Sprint(received(decoders[name], "done")); live != keys {
+			t.Errorf("%s received %s, expected %s", name, live, keys)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reveal conditions of sealed messages. A sealed message is delivered only
+// to its sender and the admin until the router sends a copy of it to its
+// period and group, with Sealed cleared and Submitted set to its Time:
+//
+//	admin   when the admin sends __reveal__
+//	period  when the first subject of the group moves on to another period
+//	all     once every subject of the period and group has sent a sealed
+//	        message with the same key
+//
+// The admin can reveal any sealed message early with __reveal__.
+const (
+	SealAdmin  = "admin"
+	SealPeriod = "period"
+	SealAll    = "all"
+)
+
+// checkSeal rejects sealed messages the router could never reveal.
+func checkSeal(msg *Msg) error {
+	switch msg.Sealed {
+	case SealAdmin, SealPeriod, SealAll:
+	default:
+		return fmt.Errorf("unknown reveal condition %q", msg.Sealed)
+	}
+	if IsReservedKey(msg.Key) {
+		return errors.New("reserved messages can't be sealed")
+	}
+	if msg.Sealed == SealPeriod && msg.Period == 0 {
+		return errors.New("period 0 never ends, messages in it can't be sealed until it does")
+	}
+	return nil
+}
+
+// seal keeps msg, which has been saved already, until it is revealed, and
+// reveals the sealed messages it completes.
+func (s *Session) seal(msg *Msg) error {
+	s.lock.Lock()
+	s.sealed = append(s.sealed, msg)
+	s.lock.Unlock()
+	if err := s.saveSealed(); err != nil {
+		return err
+	}
+	if msg.Sealed != SealAll {
+		return nil
+	}
+
+	submitted := make(map[string]bool)
+	s.lock.RLock()
+	for _, sealed := range s.sealed {
+		if sealed.Sealed == SealAll && sealed.Key == msg.Key && sealed.Period == msg.Period && sealed.Group == msg.Group {
+			submitted[sealed.Sender] = true
+		}
+	}
+	s.lock.RUnlock()
+	for _, name := range s.members(msg.Period, msg.Group) {
+		if !submitted[name] {
+			return nil
+		}
+	}
+	return s.reveal(func(sealed *Msg) bool {
+		return sealed.Sealed == SealAll && sealed.Key == msg.Key && sealed.Period == msg.Period && sealed.Group == msg.Group
+	})
+}
+
+// revealPeriod reveals the messages sealed until the period of subject
+// ends, before it moves on to another period.
+func (s *Session) revealPeriod(subject *Subject) error {
+	return s.reveal(func(sealed *Msg) bool {
+		return sealed.Sealed == SealPeriod && sealed.Period == subject.period && sealed.Group == subject.group
+	})
+}
+
+// revealMatching reveals the sealed messages selected by an admin's
+// __reveal__, whatever their condition.
+func (s *Session) revealMatching(p *RevealPayload) error {
+	return s.reveal(func(sealed *Msg) bool {
+		return (p.Key == "" || sealed.Key == p.Key) &&
+			(p.Period == 0 || sealed.Period == p.Period) &&
+			(p.Group == 0 || sealed.Group == p.Group)
+	})
+}
+
+// reveal sends a copy of every sealed message selected by match to its
+// period and group, in the order they were submitted.
+func (s *Session) reveal(match func(*Msg) bool) error {
+	var revealed []*Msg
+	s.lock.Lock()
+	pending := s.sealed[:0]
+	for _, msg := range s.sealed {
+		if match(msg) {
+			revealed = append(revealed, msg)
+		} else {
+			pending = append(pending, msg)
+		}
+	}
+	s.sealed = pending
+	s.lock.Unlock()
+	if len(revealed) == 0 {
+		return nil
+	}
+
+	if err := s.saveSealed(); err != nil {
+		return err
+	}
+	for _, sealed := range revealed {
+		msg := *sealed
+		msg.Nonce = s.nonce
+		msg.Sealed = ""
+		msg.Submitted = sealed.Time
+		msg.StateUpdate = false
+		msg.Time = time.Now().UnixNano()
+		if err := s.Receive(&msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) saveSealed() error {
+	s.lock.RLock()
+	data, err := json.Marshal(s.sealed)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	objectID := SessionObjectID{objectType: "sealed", sessionID: SessionID{s.instance, s.id}}
+	return s.router.db.SetSessionObject(objectID, data)
+}
+
+func (s *Session) loadSealed(data []byte) error {
+	var sealed []*Msg
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.sealed = sealed
+	s.lock.Unlock()
+	return nil
+}
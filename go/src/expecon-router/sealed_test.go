@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// reveals lists the revealed messages as key/sender/period/group.
+func reveals(t *testing.T, db Database) []string {
+	msgs, err := db.Messages(SessionID{"redwood", 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := make(map[string]int64)
+	origins := make(map[string]string)
+	var revealed []string
+	for msg := range msgs {
+		if msg.Sealed != "" {
+			submitted[msg.Key+msg.Sender] = msg.Time
+			origins[msg.Key+msg.Sender] = msg.Origin
+		}
+		if msg.Submitted != 0 {
+			if msg.Submitted != submitted[msg.Key+msg.Sender] || msg.Time <= msg.Submitted || msg.Origin != origins[msg.Key+msg.Sender] {
+				t.Errorf("unexpected reveal %+v", msg)
+			}
+			revealed = append(revealed, fmt.Sprintf("%s/%s/%d/%d", msg.Key, msg.Sender, msg.Period, msg.Group))
+		}
+	}
+	return revealed
+}
+
+func TestSealedMessages(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	session := router.Session("redwood", 1)
+	nonce := session.Nonce()
+	send := func(msg *Msg) {
+		msg.Instance, msg.Session, msg.Nonce = "redwood", 1, nonce
+		router.Dispatch(msg)
+	}
+	for i := 1; i <= 2; i++ {
+		name := fmt.Sprint(i)
+		router.RequestSubject("redwood", 1, name)
+		send(&Msg{Sender: name, Key: "__set_group__", Value: map[string]int{"group": 1}})
+		send(&Msg{Sender: name, Key: "__set_period__", Value: map[string]int{"period": 1}})
+	}
+
+	// revealed once both have bid
+	send(&Msg{Sender: "1", Period: 1, Key: "bid", Value: 3, Sealed: SealAll})
+	send(&Msg{Sender: "1", Period: 1, Key: "guess", Value: 7, Sealed: SealPeriod})
+	send(&Msg{Sender: "2", Origin: "admin", Period: 1, Key: "note", Value: "x", Sealed: SealAdmin})
+	router.SessionStatus("redwood", 1)
+	if revealed := reveals(t, db); len(revealed) != 0 {
+		t.Fatalf("revealed early: %v", revealed)
+	}
+	send(&Msg{Sender: "2", Period: 1, Key: "bid", Value: 4, Sealed: SealAll})
+	router.SessionStatus("redwood", 1)
+	if revealed := reveals(t, db); fmt.Sprint(revealed) != "[bid/1/1/1 bid/2/1/1]" {
+		t.Fatalf("unexpected reveals %v", revealed)
+	}
+
+	// revealed when the period ends, and by the admin
+	send(&Msg{Sender: "2", Key: "__set_period__", Value: map[string]int{"period": 2}})
+	send(&Msg{Sender: "admin", Key: "__reveal__", Value: map[string]interface{}{"key": "note"}})
+	router.SessionStatus("redwood", 1)
+	if revealed := reveals(t, db); fmt.Sprint(revealed) != "[bid/1/1/1 bid/2/1/1 guess/1/1/1 note/2/1/1]" {
+		t.Fatalf("unexpected reveals %v", revealed)
+	}
+	if len(session.sealed) != 0 {
+		t.Fatalf("still sealed: %v", session.sealed)
+	}
+
+	send(&Msg{Sender: "1", Key: "__set_period__", Value: map[string]int{"period": 1}})
+	send(&Msg{Sender: "1", Key: "__ready__", Value: 1, Sealed: SealAll})
+	send(&Msg{Sender: "1", Key: "bid", Value: 1, Sealed: "later"})
+	send(&Msg{Sender: "admin", Override: true, Key: "hint", Value: 1, Sealed: SealPeriod})
+	send(&Msg{Sender: "1", Period: 1, Key: "offer", Value: 1, Sealed: SealAdmin})
+	router.SessionStatus("redwood", 1)
+	if len(session.sealed) != 1 {
+		t.Fatalf("expected only the offer to be sealed, got %v", session.sealed)
+	}
+
+	// pending messages survive a restart
+	restarted := NewRouter(db, Options{}).Session("redwood", 1)
+	if len(restarted.sealed) != 1 || restarted.sealed[0].Key != "offer" {
+		t.Fatalf("unexpected sealed messages after restart %v", restarted.sealed)
+	}
+}
+
+func TestSealedVisibility(t *testing.T) {
+	sealed := &Msg{Sender: "1", Key: "bid", Sealed: SealAdmin}
+	for name, visible := range map[string]bool{"1": true, "2": false} {
+		listener := &Listener{subject: &Subject{name: name}, role: RoleSubject}
+		if listener.visible(sealed) != visible {
+			t.Errorf("sealed bid visible to %s: %v", name, !visible)
+		}
+	}
+	revealed := &Msg{Sender: "1", Key: "bid", Submitted: 1}
+	if !(&Listener{subject: &Subject{name: "2"}, role: RoleSubject}).visible(revealed) {
+		t.Error("reveal not visible to the group")
+	}
+}
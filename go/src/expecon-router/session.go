@@ -2,12 +2,26 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+type ListenerRequest struct {
+	listener *Listener
+	ack      chan bool
+}
+
+// ErrorReport carries an error raised outside the session loop back into
+// it, so it can be delivered to the right listeners.
+type ErrorReport struct {
+	sender string
+	err    error
+}
+
 type Session struct {
 	db_key            string
 	router            *Router
@@ -18,7 +32,32 @@ type Session struct {
 	subjects          map[string]*Subject
 	last_state_update map[string]map[string]*Msg
 	last_cfg          *Msg
+	config            []map[string]string // rows of last_cfg
+	matching          *Matching
+	rand              *rand.Rand // draws groups, owned by the loop
+	assigning         bool       // set while __assign__ moves subjects, whose periods it ends itself
 	lock              sync.RWMutex
+	deleted           bool
+	generation        int                 // bumped by every reset
+	paused            map[string]int      // period each paused subject is paused from, guarded by lock
+	pauseReported     map[string]bool     // whether a rejected message has been reported during the pause
+	timers            map[string]*Timer   // running timers by timerKey, guarded by lock
+	barriers          map[string]*Barrier // by timerKey, guarded by lock
+	ledger            map[string]*Account // by subject, guarded by lock
+	presence          map[string]string   // presence status by subject, guarded by lock
+	sealed            []*Msg              // sealed messages waiting to be revealed, guarded by lock
+	markets           map[string]*Market  // by timerKey of period and group, guarded by lock
+
+	messages        chan *Msg
+	newListeners    chan *ListenerRequest
+	closedListeners chan *Listener
+	requestSubject  chan *SubjectRequest
+	errorReports    chan *ErrorReport
+	snapshots       chan *snapshotRequest
+	timerFires      chan *timerFire
+	statusRequests  chan chan *SessionStatus
+	drains          chan chan struct{}
+	done            chan struct{} // closed once the session has been deleted
 }
 
 func NewSession(r *Router, instance string, id int) (s *Session) {
@@ -32,10 +71,100 @@ func NewSession(r *Router, instance string, id int) (s *Session) {
 		subjects:          make(map[string]*Subject),
 		last_state_update: make(map[string]map[string]*Msg),
 		last_cfg:          nil,
+		matching:          NewMatching(),
+		rand:              rand.New(rand.NewSource(time.Now().UnixNano())),
+		paused:            make(map[string]int),
+		pauseReported:     make(map[string]bool),
+		timers:            make(map[string]*Timer),
+		barriers:          make(map[string]*Barrier),
+		ledger:            make(map[string]*Account),
+		presence:          make(map[string]string),
+		markets:           make(map[string]*Market),
+		messages:          make(chan *Msg, 100),
+		newListeners:      make(chan *ListenerRequest, 100),
+		closedListeners:   make(chan *Listener, 100),
+		requestSubject:    make(chan *SubjectRequest, 100),
+		errorReports:      make(chan *ErrorReport, 100),
+		snapshots:         make(chan *snapshotRequest),
+		timerFires:        make(chan *timerFire),
+		statusRequests:    make(chan chan *SessionStatus),
+		drains:            make(chan chan struct{}),
+		done:              make(chan struct{}),
 	}
 	return s
 }
 
+// Run is the event loop of the session. All session state is owned by this
+// goroutine. It returns once the session has been deleted.
+func (s *Session) Run() {
+	defer close(s.done)
+	for !s.deleted {
+		select {
+		case request := <-s.newListeners:
+			s.addListener(request.listener)
+			request.ack <- true
+
+		case listener := <-s.closedListeners:
+			s.removeListener(listener)
+
+		case request := <-s.requestSubject:
+			request.response <- s.Subject(request.name)
+
+		case msg := <-s.messages:
+			s.handleDispatched(msg)
+
+		case report := <-s.errorReports:
+			s.SendError(report.sender, report.err)
+
+		case request := <-s.snapshots:
+			s.saveSnapshot(request)
+
+		case fire := <-s.timerFires:
+			s.fireTimer(fire)
+
+		case response := <-s.statusRequests:
+			// answer with the effect of everything dispatched so far
+			s.drainMessages()
+			response <- s.status()
+
+		case done := <-s.drains:
+			s.drainMessages()
+			for _, listener := range s.listeners {
+				listener.queue.Drain(ShutdownReason)
+			}
+			close(done)
+		}
+	}
+}
+
+// drainMessages handles the messages queued so far.
+func (s *Session) drainMessages() {
+	for !s.deleted {
+		select {
+		case msg := <-s.messages:
+			s.handleDispatched(msg)
+		default:
+			return
+		}
+	}
+}
+
+// Nonce returns the nonce of the current incarnation of the session. It is
+// safe to call from outside the session loop.
+func (s *Session) Nonce() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.nonce
+}
+
+// Generation counts the resets of the session. It is safe to call from
+// outside the session loop.
+func (s *Session) Generation() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.generation
+}
+
 func (s *Session) Subject(name string) *Subject {
 	subject, exists := s.subjects[name]
 	if !exists {
@@ -52,44 +181,307 @@ func (s *Session) Subject(name string) *Subject {
 			Period:   0,
 			Group:    0,
 		}
-		s.Receive(msg)
+		if err := s.Receive(msg); err != nil {
+			s.SendError(name, err)
+		}
 	}
 	return subject
 }
 
-func (s *Session) Receive(msg *Msg) {
+// handleDispatched handles a message dispatched from outside the session,
+// routed by its sender's state and rejected if its sender is paused. A
+// subject can't pick its own group while the router does the matching.
+func (s *Session) handleDispatched(msg *Msg) {
+	s.stamp(msg)
+	if s.blockedByPause(msg) {
+		s.rejectPaused(msg)
+		return
+	}
+	if msg.Key == "__set_group__" && msg.Origin == "" && RoleFor(msg.Sender) == RoleSubject && s.matched() {
+		s.SendError(msg.Sender, errors.New("__set_group__: groups are assigned by the router"))
+		return
+	}
+	s.HandleMessage(msg)
+}
+
+// HandleMessage applies msg to the session state, then persists and
+// delivers it.
+func (s *Session) HandleMessage(msg *Msg) {
+	var err error
+	msg.Time = time.Now().UnixNano()
+	if msg.Nonce != s.nonce {
+		return
+	}
+	s.router.metrics.Handled(msg.Key)
+
+	sessionID := SessionID{instance: s.instance, id: s.id}
+	objectID := SessionObjectID{
+		objectType: "",
+		sessionID:  sessionID,
+		subject:    msg.Sender,
+	}
+
+	var payload Payload
+	if msg.Sealed != "" {
+		err = checkSeal(msg)
+	}
+	if err == nil {
+		payload, err = DecodePayload(msg)
+	}
+	// whether msg may complete a barrier
+	release := false
+	// whether msg is for a market
+	trade := false
+
+	switch p := payload.(type) {
+	case *SetPeriodPayload:
+		var subject *Subject
+		if subject, err = s.knownSubject(msg.Sender); err != nil {
+			break
+		}
+		if *p.Period != subject.period && !s.assigning {
+			if err = s.revealPeriod(subject); err != nil {
+				break
+			}
+		}
+		var assigned bool
+		if assigned, err = s.assignGroup(subject, *p.Period); err != nil {
+			break
+		}
+		if assigned {
+			msg.Group = subject.group
+		}
+		subject.period = *p.Period
+		msg.Period = *p.Period
+		release = true
+		period_bytes := fmt.Sprintf("%d", subject.period)
+
+		objectID.objectType = "period"
+		err = s.router.db.SetSessionObject(objectID, []byte(period_bytes))
+	case *SetGroupPayload:
+		var subject *Subject
+		if subject, err = s.knownSubject(msg.Sender); err != nil {
+			break
+		}
+		subject.group = *p.Group
+		msg.Group = *p.Group
+		release = true
+		group_bytes := fmt.Sprintf("%d", subject.group)
+
+		objectID.objectType = "group"
+		err = s.router.db.SetSessionObject(objectID, []byte(group_bytes))
+	case *SetPagePayload:
+		if subject, exists := s.subjects[msg.Sender]; exists {
+			subject.page = *p.Page
+		}
+		objectID.objectType = "page"
+		err = s.router.db.SetSessionObject(objectID, []byte(*p.Page))
+	case *SetConfigPayload:
+		var config_bytes []byte
+		if config_bytes, err = json.Marshal(msg); err != nil {
+			break
+		}
+		s.last_cfg = msg
+		s.config = p.Rows
+
+		objectID.objectType = "config"
+		err = s.router.db.SetSessionObject(objectID, config_bytes)
+	case *StartTimerPayload:
+		err = s.startTimer(msg, p)
+	case *TimerPayload:
+		err = s.stopTimer(msg, p)
+	case *SetPointsPayload, *MarkPaidPayload, *AmountPayload:
+		err = s.book(msg, payload)
+	case *BarrierPayload:
+		err = s.ready(msg, p)
+		release = true
+	case *AssignPayload:
+		err = s.assign(*p.Period, p.Subjects)
+	case *RevealPayload:
+		err = s.revealMatching(p)
+	case *BidPayload, *OrderPayload, *CancelPayload, *CloseMarketPayload:
+		err = s.checkOrder(msg, payload)
+		trade = true
+	case *PeriodPayload:
+		if msg.Key != "__get_period__" {
+			err = s.handlePause(msg, *p.Period)
+		}
+	case *NoPayload:
+		switch msg.Key {
+		case "__reset__":
+			err = s.Reset()
+		case "__delete__":
+			err = s.Delete()
+		}
+	}
+
+	if err == nil && msg.StateUpdate {
+		s.lock.Lock()
+		last_msgs, exists := s.last_state_update[msg.Key]
+		if !exists {
+			last_msgs = make(map[string]*Msg)
+			s.last_state_update[msg.Key] = last_msgs
+		}
+		last_msgs[msg.Sender] = msg
+		s.lock.Unlock()
+	}
+
+	if err == nil {
+		err = s.Receive(msg)
+	}
+	if err == nil && msg.Sealed != "" {
+		err = s.seal(msg)
+	}
+	if err == nil && release {
+		err = s.releaseBarriers()
+	}
+	if err == nil && trade {
+		err = s.trade(msg, payload)
+	}
+	if err != nil {
+		s.SendError(msg.Sender, fmt.Errorf("%s: %v", msg.Key, err))
+	}
+}
+
+// loadObject restores one of the session objects that belong to the whole
+// session rather than to a subject.
+func (s *Session) loadObject(objectID SessionObjectID) error {
+	data, err := s.router.db.SessionObject(objectID)
+	if err != nil {
+		return err
+	}
+	switch objectID.objectType {
+	case "matching":
+		return json.Unmarshal(data, s.matching)
+	case "timers":
+		return s.loadTimers(data)
+	case "barriers":
+		return s.loadBarriers(data)
+	case "ledger":
+		return s.loadLedger(data)
+	case "sealed":
+		return s.loadSealed(data)
+	case "markets":
+		return s.loadMarkets(data)
+	}
+	return nil
+}
+
+// knownSubject returns the named subject, or an error if it has never
+// connected to this session.
+func (s *Session) knownSubject(name string) (*Subject, error) {
+	subject, exists := s.subjects[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown subject %q", name)
+	}
+	return subject, nil
+}
+
+// stamp sets the Period and Group of a dispatched msg from its sender's
+// state, so a client can't route messages into another period or group,
+// including period 0, which every period sees. Admin overrides are logged
+// and left as sent. Messages the session makes itself are not stamped.
+func (s *Session) stamp(msg *Msg) {
+	if msg.Override {
+		log.Printf("%s/%d: %s overrides routing of %s to period %d group %d", s.instance, s.id, msg.Sender, msg.Key, msg.Period, msg.Group)
+		return
+	}
+	subject, exists := s.subjects[msg.Sender]
+	if !exists {
+		return
+	}
+	msg.Period = subject.period
+	msg.Group = subject.group
+}
+
+// Receive persists msg and delivers it to every matching listener.
+// If msg cannot be saved it is not delivered at all, so that live
+// listeners never see a message that a later Sync would not replay.
+func (s *Session) Receive(msg *Msg) error {
 	if msg.Key != "__reset__" && msg.Key != "__delete__" {
 		if err := s.router.db.SaveMessage(msg); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
+	return s.deliver(msg)
+}
+
+// deliver sends msg to every matching listener without persisting it.
+func (s *Session) deliver(msg *Msg) error {
 	bytes, err := json.Marshal(msg)
 	if err != nil {
-		log.Fatal(err) // not really a good idea to fatal here
+		return err
 	}
-	for _, listener := range s.listeners {
-		if listener.match(s, msg) {
-			listener.Send(bytes)
+	for name, listener := range s.listeners {
+		if listener.match(s, msg) && !listener.Send(msg, bytes) {
+			delete(s.listeners, name)
 		}
 	}
+	return nil
 }
 
-func (s *Session) Reset() {
+// SendError reports err to sender and to admin as an __error__ message.
+// Errors are not persisted, so they are never replayed by Sync.
+func (s *Session) SendError(sender string, err error) {
+	log.Printf("error in session %s:%d from %s: %v", s.instance, s.id, sender, err)
+	errMsg := &Msg{
+		Instance: s.instance,
+		Session:  s.id,
+		Nonce:    s.nonce,
+		Sender:   "server",
+		Period:   0,
+		Group:    0,
+		Time:     time.Now().UnixNano(),
+		Key:      "__error__",
+		Value:    err.Error()}
+	bytes, err := json.Marshal(errMsg)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for name, listener := range s.listeners {
+		if name != sender && listener.role == RoleSubject {
+			continue
+		}
+		if !listener.Send(errMsg, bytes) {
+			delete(s.listeners, name)
+		}
+	}
+}
+
+func (s *Session) Reset() error {
+	s.lock.Lock()
 	s.nonce = uuid()
-	s.subjects = make(map[string]*Subject)
+	s.generation++
 	s.last_state_update = make(map[string]map[string]*Msg)
+	s.paused = make(map[string]int)
+	s.barriers = make(map[string]*Barrier)
+	s.ledger = make(map[string]*Account)
+	s.sealed = nil
+	s.markets = make(map[string]*Market)
+	s.lock.Unlock()
+	s.pauseReported = make(map[string]bool)
+	s.stopTimers()
+	s.subjects = make(map[string]*Subject)
+	s.config = nil
+	s.matching = NewMatching()
 
 	sessionID := SessionID{instance: s.instance, id: s.id}
-	s.router.db.DeleteSession(sessionID)
+	if err := s.router.db.DeleteSession(sessionID); err != nil {
+		return err
+	}
 
 	// replay last config
 	if s.last_cfg != nil {
 		s.last_cfg.Nonce = s.nonce
-		s.router.HandleMessage(s.last_cfg)
+		s.HandleMessage(s.last_cfg)
 	}
+	return nil
 }
 
-func (s *Session) Delete() {
-	s.Reset()
-	delete(s.router.sessions[s.instance], s.id)
+func (s *Session) Delete() error {
+	err := s.Reset()
+	s.router.removeSession(s)
+	s.deleted = true
+	return err
 }
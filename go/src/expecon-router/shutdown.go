@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// the close reason of connections dropped by a shutdown, pages reconnect
+// when they see it
+const ShutdownReason = "server restarting"
+
+// Draining reports whether the router is shutting down.
+func (r *Router) Draining() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.draining
+}
+
+// Shutdown drains every session and waits for all connections to close, or
+// for ctx to be done.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.lock.Lock()
+	r.draining = true
+	r.lock.Unlock()
+
+	for _, session := range r.Sessions() {
+		if err := session.drain(ctx); err != nil {
+			return err
+		}
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		r.connections.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		return fmt.Errorf("connections still open: %v", ctx.Err())
+	}
+
+	// persist whatever the closing connections sent last
+	for _, session := range r.Sessions() {
+		if err := session.drain(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain has the session loop handle its queued messages and close every
+// connection once its send queue is empty.
+func (s *Session) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case s.drains <- done:
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdownOnSignal shuts server and router down on SIGTERM or an interrupt,
+// then closes stopped.
+func shutdownOnSignal(server *http.Server, router *Router, options Options, stopped chan struct{}) {
+	defer close(stopped)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	signal.Stop(signals)
+
+	log.Printf("%v: shutting down, waiting up to %v for connections to close", sig, options.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+	defer cancel()
+	// hijacked websocket connections are left to the router
+	if err := server.Shutdown(ctx); err != nil {
+		log.Print(err)
+	}
+	if err := router.Shutdown(ctx); err != nil {
+		log.Printf("shutdown incomplete: %v", err)
+		return
+	}
+	log.Print("shutdown complete")
+}
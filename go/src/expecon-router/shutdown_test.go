@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	server := httptest.NewServer(websocket.Server{Handler: func(c *websocket.Conn) {
+		router.HandleWebsocket(c)
+		c.Close()
+	}})
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/redwood/1/1"
+	conn, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	received := make(chan int)
+	synced := make(chan bool)
+	go func() {
+		count := 0
+		decoder := json.NewDecoder(conn)
+		for {
+			var msg Msg
+			if err := decoder.Decode(&msg); err != nil {
+				received <- count
+				return
+			}
+			switch msg.Key {
+			case "__queue_end__":
+				synced <- true
+			case "choice":
+				count++
+			}
+		}
+	}()
+	<-synced
+
+	nonce := router.Session("redwood", 1).Nonce()
+	for i := 0; i < 50; i++ {
+		router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Key: "choice", Value: i})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := router.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case count := <-received:
+		if count != 50 {
+			t.Fatalf("connection closed after %d of 50 messages", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed")
+	}
+	msgs, err := db.Messages(SessionID{"redwood", 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := 0
+	for msg := range msgs {
+		if msg.Key == "choice" {
+			saved++
+		}
+	}
+	if saved != 50 {
+		t.Fatalf("%d of 50 messages saved", saved)
+	}
+}
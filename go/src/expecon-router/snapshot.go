@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// compact every session that has logged at least this many messages since
+// its last snapshot
+const compactThreshold = 1000
+
+// Snapshot replaces the first Index messages of a queue for replay, Sync
+// sends it and then only the tail of the queue.
+type Snapshot struct {
+	Index    int    // number of queued messages the snapshot replaces
+	Messages []*Msg // in queue order
+	// session objects at the time the snapshot was taken
+	Subjects map[string]*SubjectState
+	Config   *Msg
+	Paused   map[string]int
+}
+
+type SubjectState struct {
+	Period int
+	Group  int
+}
+
+// snapshotRequest hands a snapshot built outside the session loop back to
+// it to be saved, unless the session has been reset in the meantime.
+type snapshotRequest struct {
+	generation int
+	snapshot   *Snapshot
+}
+
+// compactMessages drops every StateUpdate message that is followed by a
+// later StateUpdate with the same key and sender.
+func compactMessages(msgs []*Msg) []*Msg {
+	latest := make(map[string]map[string]bool)
+	keep := make([]bool, len(msgs))
+	count := 0
+	for i := len(msgs) - 1; i >= 0; i-- {
+		msg := msgs[i]
+		if msg.StateUpdate {
+			if latest[msg.Key] == nil {
+				latest[msg.Key] = make(map[string]bool)
+			}
+			if latest[msg.Key][msg.Sender] {
+				continue
+			}
+			latest[msg.Key][msg.Sender] = true
+		}
+		keep[i] = true
+		count++
+	}
+
+	compacted := make([]*Msg, 0, count)
+	for i, msg := range msgs {
+		if keep[i] {
+			compacted = append(compacted, msg)
+		}
+	}
+	return compacted
+}
+
+// Compact builds a new snapshot from the last one and the messages queued
+// since, if there are at least threshold of them. The queue is read outside
+// the session loop, which is only asked to save the result.
+func (s *Session) Compact(threshold int) error {
+	generation := s.Generation()
+	sessionID := SessionID{instance: s.instance, id: s.id}
+	previous, err := s.router.db.Snapshot(sessionID)
+	if err != nil {
+		return err
+	}
+	var msgs []*Msg
+	start := 0
+	if previous != nil {
+		msgs = previous.Messages
+		start = previous.Index
+	}
+
+	tail, err := s.router.db.Messages(sessionID, start)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for msg := range tail {
+		msgs = append(msgs, msg)
+		count++
+	}
+	if count == 0 || count < threshold {
+		return nil
+	}
+
+	snapshot := &Snapshot{Index: start + count, Messages: compactMessages(msgs)}
+	select {
+	case s.snapshots <- &snapshotRequest{generation: generation, snapshot: snapshot}:
+	case <-s.done:
+	}
+	return nil
+}
+
+// saveSnapshot runs in the session loop.
+func (s *Session) saveSnapshot(request *snapshotRequest) {
+	if request.generation != s.generation {
+		// the queue it was built from is gone
+		return
+	}
+	snapshot := request.snapshot
+	snapshot.Subjects = make(map[string]*SubjectState, len(s.subjects))
+	for name, subject := range s.subjects {
+		snapshot.Subjects[name] = &SubjectState{Period: subject.period, Group: subject.group}
+	}
+	snapshot.Config = s.last_cfg
+	snapshot.Paused = s.PausedSubjects("", true)
+	if err := s.router.db.SaveSnapshot(SessionID{instance: s.instance, id: s.id}, snapshot); err != nil {
+		log.Printf("snapshot of session %s:%d failed: %v", s.instance, s.id, err)
+		return
+	}
+	log.Printf("compacted %d messages of session %s:%d into %d", snapshot.Index, s.instance, s.id, len(snapshot.Messages))
+}
+
+// CompactLoop compacts every session once per interval, forever.
+func (r *Router) CompactLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, session := range r.Sessions() {
+			if err := session.Compact(compactThreshold); err != nil {
+				log.Printf("compacting session %s:%d failed: %v", session.instance, session.id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Timer counts down in the router, so every subject of a group sees the
+// same clock and a reloaded page doesn't restart it. It sends
+// __timer_tick__ every interval, live only, and finally a queued
+// __timer_expired__.
+type Timer struct {
+	Name     string `json:"name"`
+	Period   int    `json:"period"`
+	Group    int    `json:"group"`
+	Started  int64  `json:"started"`  // router time the timer was started at
+	Duration int64  `json:"duration"` // in milliseconds
+	Interval int64  `json:"interval"` // milliseconds between ticks, 0 for none
+
+	seq   int // tells a restarted timer from the one it replaced
+	clock *time.Timer
+}
+
+// timerFire hands the firing of a timer's clock to the session loop.
+type timerFire struct {
+	key string
+	seq int
+}
+
+func timerKey(name string, period, group int) string {
+	return fmt.Sprintf("%d:%d:%s", period, group, name)
+}
+
+func (t *Timer) end() int64 {
+	return t.Started + t.Duration*int64(time.Millisecond)
+}
+
+// next returns when the timer should fire next, its next tick or its end.
+func (t *Timer) next(now int64) int64 {
+	end := t.end()
+	if t.Interval <= 0 {
+		return end
+	}
+	interval := t.Interval * int64(time.Millisecond)
+	next := t.Started + ((now-t.Started)/interval+1)*interval
+	if next > end {
+		return end
+	}
+	return next
+}
+
+// remaining returns the milliseconds left at router time now.
+func (t *Timer) remaining(now int64) int64 {
+	remaining := (t.end() - now) / int64(time.Millisecond)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func (t *Timer) value(now int64) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      t.Name,
+		"started":   t.Started,
+		"duration":  t.Duration,
+		"interval":  t.Interval,
+		"remaining": t.remaining(now),
+	}
+}
+
+// schedule arms the clock of t to fire into the session loop.
+func (s *Session) schedule(key string, t *Timer) {
+	if t.clock != nil {
+		t.clock.Stop()
+	}
+	fire := &timerFire{key: key, seq: t.seq}
+	delay := time.Duration(t.next(time.Now().UnixNano()) - time.Now().UnixNano())
+	t.clock = time.AfterFunc(delay, func() {
+		select {
+		case s.timerFires <- fire:
+		case <-s.done:
+		}
+	})
+}
+
+// startTimer starts or restarts the timer named by p in the period and
+// group of msg.
+func (s *Session) startTimer(msg *Msg, p *StartTimerPayload) error {
+	key := timerKey(p.Name, msg.Period, msg.Group)
+	t := &Timer{
+		Name:     p.Name,
+		Period:   msg.Period,
+		Group:    msg.Group,
+		Started:  msg.Time,
+		Duration: *p.Duration,
+		Interval: p.Interval,
+	}
+	s.lock.Lock()
+	if old, exists := s.timers[key]; exists {
+		old.clock.Stop()
+		t.seq = old.seq + 1
+	}
+	s.timers[key] = t
+	s.lock.Unlock()
+	s.schedule(key, t)
+	return s.saveTimers()
+}
+
+func (s *Session) stopTimer(msg *Msg, p *TimerPayload) error {
+	key := timerKey(p.Name, msg.Period, msg.Group)
+	s.lock.Lock()
+	t, exists := s.timers[key]
+	if exists {
+		t.clock.Stop()
+		delete(s.timers, key)
+	}
+	s.lock.Unlock()
+	if !exists {
+		return fmt.Errorf("no timer %q running in period %d group %d", p.Name, msg.Period, msg.Group)
+	}
+	return s.saveTimers()
+}
+
+// fireTimer runs in the session loop. It sends a tick, or the expiry once
+// the timer has run out.
+func (s *Session) fireTimer(fire *timerFire) {
+	s.lock.Lock()
+	t, exists := s.timers[fire.key]
+	if !exists || t.seq != fire.seq {
+		// stopped or restarted since
+		s.lock.Unlock()
+		return
+	}
+	now := time.Now().UnixNano()
+	expired := now >= t.end()
+	if expired {
+		delete(s.timers, fire.key)
+	}
+	s.lock.Unlock()
+
+	msg := &Msg{
+		Instance: s.instance,
+		Session:  s.id,
+		Nonce:    s.nonce,
+		Sender:   "server",
+		Period:   t.Period,
+		Group:    t.Group,
+		Time:     now,
+		Key:      "__timer_tick__",
+		Value:    t.value(now),
+	}
+	var err error
+	if expired {
+		msg.Key = "__timer_expired__"
+		if err = s.saveTimers(); err == nil {
+			err = s.Receive(msg)
+		}
+	} else {
+		s.schedule(fire.key, t)
+		err = s.deliver(msg)
+	}
+	if err != nil {
+		s.SendError("server", fmt.Errorf("timer %q: %v", t.Name, err))
+	}
+}
+
+func (s *Session) saveTimers() error {
+	s.lock.RLock()
+	data, err := json.Marshal(s.timers)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	objectID := SessionObjectID{objectType: "timers", sessionID: SessionID{s.instance, s.id}}
+	return s.router.db.SetSessionObject(objectID, data)
+}
+
+// loadTimers restarts the timers persisted before a router restart. Those
+// that ran out in the meantime fire right away.
+func (s *Session) loadTimers(data []byte) error {
+	timers := make(map[string]*Timer)
+	if err := json.Unmarshal(data, &timers); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.timers = timers
+	s.lock.Unlock()
+	for key, t := range timers {
+		s.schedule(key, t)
+	}
+	return nil
+}
+
+// stopTimers stops every clock, the timers are forgotten by a reset.
+func (s *Session) stopTimers() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.timers {
+		t.clock.Stop()
+	}
+	s.timers = make(map[string]*Timer)
+}
+
+// RunningTimers lists the running timers of the given period and group, or
+// all of them. It is safe to call from outside the session loop.
+func (s *Session) RunningTimers(period, group int, all bool) []map[string]interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	now := time.Now().UnixNano()
+	timers := make([]map[string]interface{}, 0)
+	for _, t := range s.timers {
+		if all || ((t.Period == period || t.Period == 0) && (t.Group == group || t.Group == 0)) {
+			value := t.value(now)
+			value["period"] = t.Period
+			value["group"] = t.Group
+			timers = append(timers, value)
+		}
+	}
+	return timers
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimerNext(t *testing.T) {
+	ms := int64(time.Millisecond)
+	timer := &Timer{Started: 1000 * ms, Duration: 100, Interval: 30}
+	for _, c := range [][2]int64{{1000, 1030}, {1029, 1030}, {1030, 1060}, {1095, 1100}, {1200, 1100}} {
+		if next := timer.next(c[0] * ms); next != c[1]*ms {
+			t.Errorf("at %d expected %d, got %d", c[0], c[1], next/ms)
+		}
+	}
+	timer.Interval = 0
+	if next := timer.next(1000 * ms); next != 1100*ms {
+		t.Errorf("expected the end without ticks, got %d", next/ms)
+	}
+	if remaining := timer.remaining(1040 * ms); remaining != 60 {
+		t.Errorf("expected 60ms remaining, got %d", remaining)
+	}
+}
+
+func TestSessionTimers(t *testing.T) {
+	db := NewMemoryDatabase()
+	router := NewRouter(db, Options{})
+	session := router.Session("redwood", 1)
+	router.RequestSubject("redwood", 1, "1")
+	nonce := session.Nonce()
+	// timers are routed by the subject's own period and group
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Key: "__set_group__", Value: map[string]interface{}{"group": 2}})
+	router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Key: "__set_period__", Value: map[string]interface{}{"period": 1}})
+	start := func(name string, duration int64) {
+		router.Dispatch(&Msg{Instance: "redwood", Session: 1, Nonce: nonce, Sender: "1", Period: 1, Group: 2,
+			Key: "__start_timer__", Value: map[string]interface{}{"name": name, "duration": duration, "interval": 10}})
+	}
+	start("round", 50)
+	start("session", 3600000)
+	time.Sleep(200 * time.Millisecond)
+	router.SessionStatus("redwood", 1)
+
+	msgs, err := db.Messages(SessionID{"redwood", 1}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := 0
+	for msg := range msgs {
+		switch msg.Key {
+		case "__timer_tick__":
+			t.Error("tick was queued")
+		case "__timer_expired__":
+			expired++
+			if msg.Period != 1 || msg.Group != 2 || msg.Value.(map[string]interface{})["name"] != "round" {
+				t.Errorf("unexpected expiry %+v", msg)
+			}
+		}
+	}
+	if expired != 1 {
+		t.Fatalf("expected 1 expiry, got %d", expired)
+	}
+
+	// the running timer survives a restart
+	restarted := NewRouter(db, Options{}).Session("redwood", 1)
+	timers := restarted.RunningTimers(1, 2, false)
+	if len(timers) != 1 || timers[0]["name"] != "session" {
+		t.Fatalf("unexpected timers after restart %v", timers)
+	}
+	if other := restarted.RunningTimers(1, 3, false); len(other) != 0 {
+		t.Fatalf("timer visible to another group: %v", other)
+	}
+	restarted.stopTimers()
+}
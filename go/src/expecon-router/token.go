@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenProtocolPrefix marks a websocket subprotocol that carries a token.
+const TokenProtocolPrefix = "redwood-token."
+
+// TokenClaims say who a connection may act as, and until when.
+type TokenClaims struct {
+	Instance string `json:"instance"`
+	Session  int    `json:"session"`
+	Subject  string `json:"subject"`
+	Expires  int64  `json:"expires"` // unix seconds
+}
+
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrBadSignature   = errors.New("bad token signature")
+	ErrExpiredToken   = errors.New("token has expired")
+)
+
+func tokenSignature(secret []byte, encodedClaims string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encodedClaims))
+	return mac.Sum(nil)
+}
+
+// SignToken returns the base64url encoded JSON claims, a ".", and the
+// base64url encoded HMAC-SHA256 of the encoded claims under secret, which is
+// shared with the Django app.
+func SignToken(secret []byte, claims *TokenClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encodedClaims := base64.RawURLEncoding.EncodeToString(data)
+	signature := base64.RawURLEncoding.EncodeToString(tokenSignature(secret, encodedClaims))
+	return encodedClaims + "." + signature, nil
+}
+
+// VerifyToken checks the signature and expiry of token and returns its claims.
+func VerifyToken(secret []byte, token string, now time.Time) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrMalformedToken
+	}
+	// base64 implementations disagree on padding, so accept both
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !hmac.Equal(signature, tokenSignature(secret, parts[0])) {
+		return nil, ErrBadSignature
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if now.Unix() >= claims.Expires {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// Permits reports whether the claims allow connecting to the given
+// instance/session as subject.
+func (claims *TokenClaims) Permits(instance string, session int, subject string) error {
+	if claims.Instance != instance || claims.Session != session || claims.Subject != subject {
+		return fmt.Errorf("token is for %s/%d/%s", claims.Instance, claims.Session, claims.Subject)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+	"websocket"
+)
+
+func TestVerifyToken(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	claims := &TokenClaims{Instance: "redwood", Session: 1, Subject: "3", Expires: now.Add(time.Hour).Unix()}
+	token, err := SignToken(secret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified, err := VerifyToken(secret, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verified.Permits("redwood", 1, "3"); err != nil {
+		t.Error(err)
+	}
+	if err := verified.Permits("redwood", 1, "admin"); err == nil {
+		t.Error("token for subject 3 permitted admin")
+	}
+
+	if _, err := VerifyToken([]byte("other"), token, now); err != ErrBadSignature {
+		t.Errorf("expected ErrBadSignature, got %v", err)
+	}
+	if _, err := VerifyToken(secret, token, now.Add(2*time.Hour)); err != ErrExpiredToken {
+		t.Errorf("expected ErrExpiredToken, got %v", err)
+	}
+	if _, err := VerifyToken(secret, "garbage", now); err != ErrMalformedToken {
+		t.Errorf("expected ErrMalformedToken, got %v", err)
+	}
+}
+
+func TestHandshakeWebsocket(t *testing.T) {
+	r := &Router{secret: []byte("secret")}
+	claims := &TokenClaims{Instance: "redwood", Session: 1, Subject: "3", Expires: time.Now().Add(time.Hour).Unix()}
+	token, err := SignToken(r.secret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(path string, protocols []string, cookie string) (*websocket.Config, error) {
+		location, err := url.ParseRequestURI("ws://127.0.0.1:8080" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{URL: location, Header: make(http.Header)}
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		config := &websocket.Config{Location: location, Protocol: protocols}
+		return config, r.HandshakeWebsocket(config, req)
+	}
+
+	if _, err := handshake("/redwood/1/3", []string{""}, ""); err == nil {
+		t.Error("connection without a token was accepted")
+	}
+	if _, err := handshake("/redwood/1/3?token="+token, []string{""}, ""); err != nil {
+		t.Error(err)
+	}
+	if _, err := handshake("/redwood/1/admin?token="+token, []string{""}, ""); err == nil {
+		t.Error("subject token was accepted for admin")
+	}
+	if _, err := handshake("/redwood/1/3", []string{""}, "redwood_token_1_3="+token); err != nil {
+		t.Error(err)
+	}
+	config, err := handshake("/redwood/1/3", []string{"chat", TokenProtocolPrefix + token}, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(config.Protocol) != 1 || config.Protocol[0] != TokenProtocolPrefix+token {
+		t.Errorf("token subprotocol was not selected: %v", config.Protocol)
+	}
+}
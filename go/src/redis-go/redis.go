@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -24,6 +25,8 @@ type Client struct {
 	Addr     string
 	Db       int
 	Password string
+	// if set, called after every command with its latency and error
+	Observe func(cmd string, elapsed time.Duration, err error)
 	//the connection pool
 	pool chan net.Conn
 }
@@ -186,6 +189,10 @@ func (client *Client) openConnection() (c net.Conn, err error) {
 func (client *Client) sendCommand(cmd string, args ...string) (data interface{}, err error) {
 
 	var b []byte
+	if client.Observe != nil {
+		start := time.Now()
+		defer func() { client.Observe(cmd, time.Since(start), err) }()
+	}
 	// grab a connection from the pool
 	c, err := client.popCon()
 
@@ -232,7 +232,7 @@ func (handler *hixiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 	return frame, nil
 }
 
-func (handler *hixiFrameHandler) WriteClose(_ int) (err error) {
+func (handler *hixiFrameHandler) WriteClose(_ int, _ string) (err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
 	closingFrame := []byte{'\xff', '\x00'}
@@ -240,6 +240,10 @@ func (handler *hixiFrameHandler) WriteClose(_ int) (err error) {
 	return handler.conn.buf.Flush()
 }
 
+func (handler *hixiFrameHandler) WritePing(_ []byte) (err error) {
+	return ErrNotSupported
+}
+
 // newHixiConn creates a new WebSocket connection speaking hixie draft protocol.
 func newHixieConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCloser, request *http.Request) *Conn {
 	if buf == nil {
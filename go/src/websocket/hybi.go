@@ -40,6 +40,13 @@ const (
 	maxControlFramePayloadLength = 125
 )
 
+// Close status codes for CloseWithReason.
+const (
+	CloseStatusNormal          = closeStatusNormal
+	CloseStatusGoingAway       = closeStatusGoingAway
+	CloseStatusPolicyViolation = closeStatusPolicyViolation
+)
+
 var (
 	ErrBadMaskingKey         = &ProtocolError{"bad masking key"}
 	ErrBadPongMessage        = &ProtocolError{"bad pong message"}
@@ -257,13 +264,13 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 	if handler.conn.IsServerConn() {
 		// The client MUST mask all frames sent to the server.
 		if frame.(*hybiFrameReader).header.MaskingKey == nil {
-			handler.WriteClose(closeStatusProtocolError)
+			handler.WriteClose(closeStatusProtocolError, "")
 			return nil, io.EOF
 		}
 	} else {
 		// The server MUST NOT mask all frames.
 		if frame.(*hybiFrameReader).header.MaskingKey != nil {
-			handler.WriteClose(closeStatusProtocolError)
+			handler.WriteClose(closeStatusProtocolError, "")
 			return nil, io.EOF
 		}
 	}
@@ -280,7 +287,8 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 	case PingFrame:
 		pingMsg := make([]byte, maxControlFramePayloadLength)
 		n, err := io.ReadFull(frame, pingMsg)
-		if err != nil && err != io.ErrUnexpectedEOF {
+		// payloads shorter than the buffer, including empty ones, are fine
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 			return nil, err
 		}
 		io.Copy(ioutil.Discard, frame)
@@ -290,20 +298,30 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 		}
 		return nil, nil
 	case PongFrame:
-		return nil, ErrNotImplemented
+		pongMsg := make([]byte, maxControlFramePayloadLength)
+		n, err := io.ReadFull(frame, pongMsg)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		io.Copy(ioutil.Discard, frame)
+		if handler.conn.OnPong != nil {
+			handler.conn.OnPong(pongMsg[:n])
+		}
+		return nil, nil
 	}
 	return frame, nil
 }
 
-func (handler *hybiFrameHandler) WriteClose(status int) (err error) {
+func (handler *hybiFrameHandler) WriteClose(status int, reason string) (err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
 	w, err := handler.conn.frameWriterFactory.NewFrameWriter(CloseFrame)
 	if err != nil {
 		return err
 	}
-	msg := make([]byte, 2)
+	msg := make([]byte, 2, 2+len(reason))
 	binary.BigEndian.PutUint16(msg, uint16(status))
+	msg = append(msg, reason...)
 	_, err = w.Write(msg)
 	w.Close()
 	return err
@@ -321,6 +339,18 @@ func (handler *hybiFrameHandler) WritePong(msg []byte) (n int, err error) {
 	return n, err
 }
 
+func (handler *hybiFrameHandler) WritePing(msg []byte) (err error) {
+	handler.conn.wio.Lock()
+	defer handler.conn.wio.Unlock()
+	w, err := handler.conn.frameWriterFactory.NewFrameWriter(PingFrame)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	w.Close()
+	return err
+}
+
 // newHybiConn creates a new WebSocket connection speaking hybi draft protocol.
 func newHybiConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCloser, request *http.Request) *Conn {
 	if buf == nil {
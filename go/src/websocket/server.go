@@ -11,7 +11,7 @@ import (
 	"net/http"
 )
 
-func newServerConn(rwc io.ReadWriteCloser, buf *bufio.ReadWriter, req *http.Request) (conn *Conn, err error) {
+func newServerConn(rwc io.ReadWriteCloser, buf *bufio.ReadWriter, req *http.Request, handshake func(*Config, *http.Request) error) (conn *Conn, err error) {
 	config := new(Config)
 	var hs serverHandshaker = &hybiServerHandshaker{Config: config}
 	code, err := hs.ReadHandshake(buf.Reader, req)
@@ -38,7 +38,19 @@ func newServerConn(rwc io.ReadWriteCloser, buf *bufio.ReadWriter, req *http.Requ
 		buf.Flush()
 		return
 	}
-	config.Protocol = nil
+	if handshake != nil {
+		err = handshake(config, req)
+		if err != nil {
+			code = http.StatusForbidden
+			fmt.Fprintf(buf, "HTTP/1.1 %03d %s\r\n", code, http.StatusText(code))
+			buf.WriteString("\r\n")
+			buf.WriteString(err.Error())
+			buf.Flush()
+			return
+		}
+	} else {
+		config.Protocol = nil
+	}
 
 	err = hs.AcceptHandshake(buf.Writer)
 	if err != nil {
@@ -57,16 +69,33 @@ type Handler func(*Conn)
 
 // ServeHTTP implements the http.Handler interface for a Web Socket
 func (h Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveWebSocket(w, req, nil, h)
+}
+
+// Server is a Handler with an optional Handshake function, which is called
+// after the client handshake has been read. It can reject the connection by
+// returning an error, or select a subprotocol by leaving exactly one entry
+// in config.Protocol. Without a Handshake, no subprotocol is selected.
+type Server struct {
+	Handshake func(*Config, *http.Request) error
+	Handler
+}
+
+// ServeHTTP implements the http.Handler interface for a Web Socket
+func (s Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	serveWebSocket(w, req, s.Handshake, s.Handler)
+}
+
+func serveWebSocket(w http.ResponseWriter, req *http.Request, handshake func(*Config, *http.Request) error, h Handler) {
 	rwc, buf, err := w.(http.Hijacker).Hijack()
 	if err != nil {
 		panic("Hijack failed: " + err.Error())
-		return
 	}
 	// The server should abort the WebSocket connection if it finds
 	// the client did not send a handshake that matches with protocol
 	// specification.
 	defer rwc.Close()
-	conn, err := newServerConn(rwc, buf, req)
+	conn, err := newServerConn(rwc, buf, req, handshake)
 	if err != nil {
 		return
 	}
@@ -141,7 +141,8 @@ type frameWriterFactory interface {
 
 type frameHandler interface {
 	HandleFrame(frame frameReader) (r frameReader, err error)
-	WriteClose(status int) (err error)
+	WriteClose(status int, reason string) (err error)
+	WritePing(msg []byte) (err error)
 }
 
 // Conn represents a WebSocket connection.
@@ -162,6 +163,9 @@ type Conn struct {
 	frameHandler
 	PayloadType        byte
 	defaultCloseStatus int
+
+	// if set, called from Read with the payload of every pong received
+	OnPong func(msg []byte)
 }
 
 // Read implements the io.Reader interface:
@@ -216,11 +220,33 @@ func (ws *Conn) Write(msg []byte) (n int, err error) {
 
 // Close implements the io.Closer interface.
 func (ws *Conn) Close() error {
-	err := ws.frameHandler.WriteClose(ws.defaultCloseStatus)
-	if err != nil {
-		return err
+	return ws.CloseWithReason(ws.defaultCloseStatus, "")
+}
+
+// CloseWithReason closes the connection, sending status and a short reason
+// to the peer in the close frame. The hixie protocols can't carry either, so
+// they are dropped there. Reasons longer than a control frame allows are
+// truncated.
+func (ws *Conn) CloseWithReason(status int, reason string) error {
+	if len(reason) > maxControlFramePayloadLength-2 {
+		reason = reason[:maxControlFramePayloadLength-2]
+	}
+	err := ws.frameHandler.WriteClose(status, reason)
+	// close the connection even if the peer can't be told, so a dead
+	// peer doesn't keep it open
+	if closeErr := ws.rwc.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Ping sends a ping frame carrying msg, which the peer echoes in a pong.
+// The hixie protocols have no pings, there it returns ErrNotSupported.
+func (ws *Conn) Ping(msg []byte) error {
+	if len(msg) > maxControlFramePayloadLength {
+		return ErrBadFrame
 	}
-	return ws.rwc.Close()
+	return ws.frameHandler.WritePing(msg)
 }
 
 func (ws *Conn) IsClientConn() bool { return ws.request == nil }
@@ -166,6 +166,14 @@ LOGGING = {
     }
 }
 
+# Shared with the router's -secret flag to sign websocket connection tokens.
+# Leave empty if the router runs without authentication.
+ROUTER_SECRET = app_config.get('ROUTER_SECRET', '')
+
+# The router's -data directory. Compacted messages are archived there, and
+# have to be read back from it for data export.
+ROUTER_DATA_DIR = app_config.get('ROUTER_DATA_DIR', '')
+
 REDIS_HOST = '127.0.0.1'
 REDIS_PORT = 6379
 REDIS_DB = 0